@@ -2,18 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/kazeburo/wsgate-server/internal/apikey"
 	"github.com/kazeburo/wsgate-server/internal/handler"
 	"github.com/kazeburo/wsgate-server/internal/mapping"
 	"github.com/kazeburo/wsgate-server/internal/publickey"
@@ -26,14 +31,57 @@ var (
 	Version           string
 	showVersion       = flag.Bool("version", false, "Show version")
 	listen            = flag.String("listen", "127.0.0.1:8086", "Address to listen to")
+	adminListen       = flag.String("admin_listen", "", "Address to serve /upstreams on. Not served on listen as it has upstream addresses. Empty = disable")
 	handshakeTimeout  = flag.Duration("handshake_timeout", 10*time.Second, "Handshake timeout")
 	dialTimeout       = flag.Duration("dial_timeout", 10*time.Second, "Dial timeout")
-	writeTimeout      = flag.Duration("write_timeout", 10*time.Second, "Write timeout")
+	dialAttempts      = flag.Int("dial_attempts", 3, "Max number of upstreams in a pool to try to connect")
+	dialTotalTimeout  = flag.Duration("dial_total_timeout", 0, "Time budget for all dial attempts. 0 = dial_timeout of each attempt only")
+	writeTimeout      = flag.Duration("write_timeout", 10*time.Second, "Timeout of each write to the client and the upstream. 0 = disable")
+	readTimeout       = flag.Duration("read_timeout", 0, "Close sessions when nothing is read from the client or the upstream for this time, in each direction. 0 = disable")
+	idleTimeout       = flag.Duration("idle_timeout", 0, "Close sessions without traffic in either direction for this time. 0 = disable")
+	maxLifetime       = flag.Duration("max_lifetime", 0, "Max duration of sessions. 0 = disable")
+	pingInterval      = flag.Duration("ping_interval", 0, "Interval to send WebSocket pings to clients. 0 = disable")
+	pongWait          = flag.Duration("pong_wait", 60*time.Second, "Time to wait for a pong or a message from clients before closing the session. Must be longer than ping_interval")
 	shutdownTimeout   = flag.Duration("shutdown_timeout", 86400*time.Second, "Timeout to wait for all connections to be closed")
 	enableCompression = flag.Bool("enable_compression", false, "To enable WebSocket Per-Message Compression Extensions (RFC 7692)")
 	mapFile           = flag.String("map", "", "Path and proxy host mapping file")
+	mapWatchInterval  = flag.Duration("map_watch_interval", 0, "Interval to check the map file for changes. 0 = disable")
+	hcInterval        = flag.Duration("health_check_interval", 0, "Interval of TCP health checks to upstreams. 0 = disable")
+	hcTimeout         = flag.Duration("health_check_timeout", 2*time.Second, "Timeout of a TCP health check")
+	hcRise            = flag.Int("health_check_rise", 2, "Consecutive successes to mark an upstream up")
+	hcFall            = flag.Int("health_check_fall", 3, "Consecutive failures to mark an upstream down")
+	outlierFailures   = flag.Int("outlier_consecutive_failures", 0, "Consecutive dial errors or early disconnects to eject an upstream. 0 = disable")
+	outlierEjection   = flag.Duration("outlier_ejection_time", 30*time.Second, "Base time to eject an upstream. Multiplied by the number of ejections in a row")
+	outlierEarly      = flag.Duration("outlier_early_disconnect", 10*time.Millisecond, "Sessions closed by the upstream within this time after connecting count as failures")
 	publicKeyFile     = flag.String("public-key", "", "Public key for verifying JWT auth header")
+	jwksSource        = flag.String("jwks", "", "Path or http(s) URL of JWKS for verifying JWT auth header")
+	jwksRefresh       = flag.Duration("jwks-refresh", time.Hour, "Interval to refetch JWKS")
+	jwksMinRefresh    = flag.Duration("jwks-min-refresh", time.Minute, "Minimum interval to refetch JWKS for an unknown kid")
+	jwtAlgorithms     = flag.String("jwt-algorithms", "", "Comma separated JWT algorithms to allow. Default: the ones of the key types")
+	jwtIssuer         = flag.String("jwt-issuer", "", "Comma separated issuers. The iss claim must be one of them")
+	jwtAudience       = flag.String("jwt-audience", "", "Comma separated audiences. The aud claim must contain one of them")
+	jwtLeeway         = flag.Duration("jwt-leeway", 0, "Allowed clock skew when checking exp, nbf and iat")
+	jwtRequireClaims  stringList
+	jwtOneTime        = flag.Bool("jwt-one-time", false, "Allow each JWT to be used only once. Tokens must have jti")
+	jwtReplayCache    = flag.Int("jwt-replay-cache-size", 100000, "Max number of jti to remember for -jwt-one-time")
+	jwtExpireSession  = flag.Bool("jwt-expire-session", false, "Close sessions when the JWT expires")
+	jwtExpireGrace    = flag.Duration("jwt-expire-grace", 0, "Grace period after the JWT expires before closing the session")
+	jwtReauth         = flag.Bool("jwt-reauth", false, "Allow clients to extend sessions by sending a new JWT in a text message")
+	jwtRevocation     = flag.String("jwt-revocation-list", "", "Path of the list of revoked jti, subjects and issued-before times. Sessions of revoked tokens are closed")
+	jwtRevocationPoll = flag.Duration("jwt-revocation-interval", 10*time.Second, "Interval to check the revocation list for changes")
+	jwtQueryParam     = flag.String("jwt-query-param", "", "Query parameter to accept JWT from, for clients which can not set Authorization header. Empty = disable")
+	jwtSubprotocol    = flag.Bool("jwt-subprotocol", false, "Accept JWT in WebSocket subprotocol bearer.<token>")
+	iapAudience       = flag.String("iap-audience", "", "Comma separated audiences of Google Cloud IAP. Verify X-Goog-IAP-JWT-Assertion instead of trusting X-Goog-Authenticated-User-Email")
+	iapJWKS           = flag.String("iap-jwks", publickey.IAPJWKS, "Path or http(s) URL of JWKS for verifying X-Goog-IAP-JWT-Assertion")
 	jwtFreshness      = flag.Duration("jwt-freshness", 3600*time.Second, "Time in seconds to allow generated jwt tokens")
+	apiKeysFile       = flag.String("api-keys", "", "Path of the file of hashed API keys for Authorization: ApiKey header")
+	authOrder         = flag.String("auth-order", strings.Join(handler.DefaultAuthOrder, ","), "Comma separated order to try authentication methods: client-cert, api-key, jwt, iap and header")
+	tlsCertFile       = flag.String("tls_cert_file", "", "Certificate file in PEM to serve TLS")
+	tlsKeyFile        = flag.String("tls_key_file", "", "Private key file in PEM to serve TLS")
+	tlsClientCA       = flag.String("tls_client_ca", "", "CA certificates in PEM to verify TLS client certificates. Enables client certificate authentication")
+	tlsClientAuth     = flag.String("tls_client_auth", "require", "require: reject clients without a valid certificate, optional: authenticate clients without certificate by the other methods")
+	tlsClientIdentity = flag.String("tls_client_identity", "cn", "Field of client certificates used as the user: cn, subject, email, dns or uri")
+	trustedProxies    = flag.String("trusted_proxies", "", "Comma separated IPs or CIDRs of proxies whose X-Forwarded-For is trusted")
 	dumpTCP           = flag.Uint("dump-tcp", 0, "Dump TCP. 0 = disable, 1 = src to dest, 2 = both")
 )
 
@@ -46,6 +94,80 @@ Compiler: %s %s
 		runtime.Version())
 }
 
+// stringList flag which can be specified multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func init() {
+	flag.Var(&jwtRequireClaims, "jwt-require-claim", `Claim requirement like 'groups contains "dba"' or 'email_verified == true'. Can be specified multiple times`)
+}
+
+// splitList split comma separated values, ignoring empty ones
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range splitList(s) {
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// serverTLSConfig TLS config to serve, verifying client certificates with clientCA if given
+func serverTLSConfig(clientCA, clientAuth string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCA == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", clientCA)
+	}
+	config.ClientCAs = pool
+	switch clientAuth {
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown tls_client_auth: %s", clientAuth)
+	}
+	return config, nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -61,11 +183,72 @@ func main() {
 		logger.Fatal("Failed init mapping", zap.Error(err))
 	}
 
-	pk, err := publickey.New(*publicKeyFile, *jwtFreshness, logger)
+	pkOpts := []publickey.Option{
+		publickey.WithJWKS(*jwksSource, *jwksRefresh, *jwksMinRefresh),
+		publickey.WithAlgorithms(splitList(*jwtAlgorithms)),
+		publickey.WithIssuer(splitList(*jwtIssuer)),
+		publickey.WithAudience(splitList(*jwtAudience)),
+		publickey.WithLeeway(*jwtLeeway),
+		publickey.WithRequiredClaims(jwtRequireClaims),
+	}
+	var rv *publickey.Revocation
+	if *jwtRevocation != "" {
+		rv, err = publickey.NewRevocation(*jwtRevocation, logger)
+		if err != nil {
+			logger.Fatal("Failed init revocation list", zap.Error(err))
+		}
+		pkOpts = append(pkOpts, publickey.WithRevocation(rv))
+	}
+	if *jwtOneTime {
+		pkOpts = append(pkOpts, publickey.WithReplayCache(publickey.NewMemoryReplayCache(*jwtReplayCache)))
+	}
+	pk, err := publickey.New(*publicKeyFile, *jwtFreshness, logger, pkOpts...)
 	if err != nil {
 		logger.Fatal("Failed init publickey", zap.Error(err))
 	}
 
+	var iap *publickey.Publickey
+	if *iapAudience != "" {
+		iap, err = publickey.NewIAP(splitList(*iapAudience), *jwtFreshness, logger,
+			publickey.WithJWKS(*iapJWKS, *jwksRefresh, *jwksMinRefresh),
+			publickey.WithLeeway(*jwtLeeway),
+		)
+		if err != nil {
+			logger.Fatal("Failed init IAP verifier", zap.Error(err))
+		}
+	}
+
+	var keys *apikey.Keys
+	if *apiKeysFile != "" {
+		keys, err = apikey.New(*apiKeysFile, logger)
+		if err != nil {
+			logger.Fatal("Failed init API keys", zap.Error(err))
+		}
+	}
+
+	trusted, err := parsePrefixes(*trustedProxies)
+	if err != nil {
+		logger.Fatal("Failed to parse trusted_proxies", zap.Error(err))
+	}
+
+	handlerOpts := []handler.Option{
+		handler.WithDialFailover(*dialAttempts, *dialTotalTimeout),
+		handler.WithOutlierDetection(*outlierFailures, *outlierEjection, *outlierEarly),
+		handler.WithTrustedProxies(trusted),
+		handler.WithIAP(iap),
+		handler.WithTokenTransport(*jwtQueryParam, *jwtSubprotocol),
+		handler.WithTokenExpiry(*jwtExpireSession, *jwtExpireGrace, *jwtReauth),
+		handler.WithAuthOrder(splitList(*authOrder)),
+		handler.WithKeepalive(*pingInterval, *pongWait),
+		handler.WithSessionLimits(*idleTimeout, *maxLifetime),
+		handler.WithReadTimeout(*readTimeout),
+	}
+	if keys != nil {
+		handlerOpts = append(handlerOpts, handler.WithAPIKeys(keys))
+	}
+	if *tlsClientCA != "" {
+		handlerOpts = append(handlerOpts, handler.WithClientCert(*tlsClientIdentity))
+	}
 	proxyHandler, err := handler.New(
 		*handshakeTimeout,
 		*dialTimeout,
@@ -75,6 +258,7 @@ func main() {
 		pk,
 		*dumpTCP,
 		logger,
+		handlerOpts...,
 	)
 	if err != nil {
 		logger.Fatal("Failed init handler", zap.Error(err))
@@ -102,12 +286,77 @@ func main() {
 	m.HandleFunc("/live", proxyHandler.Hello())
 	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(wg))
 
+	if *adminListen != "" {
+		am := mux.NewRouter()
+		am.HandleFunc("/upstreams", proxyHandler.Upstreams())
+		al, err := net.Listen("tcp", *adminListen)
+		if err != nil {
+			logger.Fatal("Failed to listen to admin port", zap.String("admin_listen", *adminListen), zap.Error(err))
+		}
+		admin := &http.Server{
+			Handler:      am,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := admin.Serve(al); err != nil {
+				logger.Error("Error in admin Serve", zap.Error(err))
+			}
+		}()
+	}
+
 	s := &http.Server{
 		Handler:        m,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
+	if *tlsCertFile != "" {
+		tlsConfig, err := serverTLSConfig(*tlsClientCA, *tlsClientAuth)
+		if err != nil {
+			logger.Fatal("Failed to configure TLS", zap.Error(err))
+		}
+		s.TLSConfig = tlsConfig
+	} else if *tlsClientCA != "" {
+		logger.Fatal("tls_client_ca requires tls_cert_file and tls_key_file")
+	}
+
+	go mp.Watch(context.Background(), *mapWatchInterval)
+	go mp.HealthCheck(context.Background(), mapping.HealthCheckConfig{
+		Interval: *hcInterval,
+		Timeout:  *hcTimeout,
+		Rise:     *hcRise,
+		Fall:     *hcFall,
+	})
+
+	if rv != nil {
+		go rv.Watch(context.Background(), *jwtRevocationPoll, proxyHandler.CloseRevoked)
+	}
+
+	go func() {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		for range hupChan {
+			logger.Info("SIGHUP received. Reload map", zap.String("map", *mapFile))
+			if err := mp.Reload(); err != nil {
+				logger.Error("Failed to reload map. Keep current map", zap.Error(err))
+			}
+			if keys != nil {
+				if err := keys.Reload(); err != nil {
+					logger.Error("Failed to reload API keys. Keep current keys", zap.Error(err))
+				}
+			}
+			if rv != nil {
+				changed, err := rv.Reload()
+				if err != nil {
+					logger.Error("Failed to reload revocation list. Keep current list", zap.Error(err))
+				}
+				if changed {
+					proxyHandler.CloseRevoked()
+				}
+			}
+		}
+	}()
 
 	idleConnsClosed := make(chan struct{})
 	go func() {
@@ -133,7 +382,12 @@ func main() {
 		}
 	}
 
-	if err := s.Serve(l); err != http.ErrServerClosed {
+	if *tlsCertFile != "" {
+		err = s.ServeTLS(l, *tlsCertFile, *tlsKeyFile)
+	} else {
+		err = s.Serve(l)
+	}
+	if err != http.ErrServerClosed {
 		logger.Error("Error in Serve", zap.Error(err))
 	}
 
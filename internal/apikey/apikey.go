@@ -0,0 +1,325 @@
+package apikey
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/kazeburo/wsgate-server/internal/auth"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+	"gopkg.in/yaml.v3"
+)
+
+// Scheme of Authorization header
+const Scheme = "ApiKey"
+
+// AllDestinations destinations entry that allows every destination
+const AllDestinations = "*"
+
+// AuthMethod name of the authentication method of identities from API keys
+const AuthMethod = "api-key"
+
+// IDSeparator separates the id and the secret of keys hashed by argon2id, as "<id>.<secret>"
+const IDSeparator = "."
+
+// limits of argon2id parameters. m is in KiB
+const (
+	maxArgon2Memory  = 256 * 1024
+	maxArgon2Time    = 16
+	maxArgon2Threads = 16
+	minArgon2KeyLen  = 16
+	maxArgon2KeyLen  = 64
+)
+
+// maxArgon2Checks number of argon2id hashes computed at once. Requests over it are rejected
+const maxArgon2Checks = 4
+
+// minIDLen minimum length of the id of keys hashed by argon2id
+const minIDLen = 8
+
+// keysFile format of the API keys file
+//
+//	keys:
+//	  - name: ci-deploy
+//	    hash: sha256:<hex>
+//	    destinations: [mysql]
+//	  - name: backup
+//	    id: 3f9a1c0e7b2d
+//	    hash: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+//	    destinations: ["*"]
+type keysFile struct {
+	Keys []keyConfig `yaml:"keys"`
+}
+
+type keyConfig struct {
+	Name         string   `yaml:"name"`
+	ID           string   `yaml:"id"`
+	Hash         string   `yaml:"hash"`
+	Destinations []string `yaml:"destinations"`
+}
+
+// Key API key
+type Key struct {
+	Name string
+	// ID prefix of keys hashed by argon2id. Empty for sha256
+	ID           string
+	Destinations []string
+	hash         hash
+}
+
+// Allow the key is allowed to use dest
+func (k *Key) Allow(dest string) bool {
+	for _, d := range k.Destinations {
+		if d == dest || d == AllDestinations {
+			return true
+		}
+	}
+	return false
+}
+
+type hash interface {
+	match(key string) bool
+}
+
+// sha256Hash "sha256:<hex>"
+type sha256Hash []byte
+
+func (h sha256Hash) match(key string) bool {
+	sum := sha256.Sum256([]byte(key))
+	return subtle.ConstantTimeCompare(h, sum[:]) == 1
+}
+
+// argon2Hash PHC string "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>"
+type argon2Hash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	sum     []byte
+}
+
+func (h *argon2Hash) match(key string) bool {
+	sum := argon2.IDKey([]byte(key), h.salt, h.time, h.memory, h.threads, uint32(len(h.sum)))
+	return subtle.ConstantTimeCompare(h.sum, sum) == 1
+}
+
+func (h *argon2Hash) validate() error {
+	if h.time < 1 || h.time > maxArgon2Time {
+		return errors.Errorf("argon2id t must be 1 to %d", maxArgon2Time)
+	}
+	if h.threads < 1 || h.threads > maxArgon2Threads {
+		return errors.Errorf("argon2id p must be 1 to %d", maxArgon2Threads)
+	}
+	if h.memory < 8*uint32(h.threads) || h.memory > maxArgon2Memory {
+		return errors.Errorf("argon2id m must be 8*p to %d", maxArgon2Memory)
+	}
+	if len(h.sum) < minArgon2KeyLen || len(h.sum) > maxArgon2KeyLen {
+		return errors.Errorf("argon2id hash must be %d to %d bytes", minArgon2KeyLen, maxArgon2KeyLen)
+	}
+	return nil
+}
+
+func parseHash(s string) (hash, error) {
+	if hexSum, ok := strings.CutPrefix(s, "sha256:"); ok {
+		b, err := hex.DecodeString(hexSum)
+		if err != nil || len(b) != sha256.Size {
+			return nil, errors.New("invalid sha256 hash")
+		}
+		return sha256Hash(b), nil
+	}
+	if strings.HasPrefix(s, "$argon2id$") {
+		f := strings.Split(s, "$")
+		if len(f) != 6 || f[2] != fmt.Sprintf("v=%d", argon2.Version) {
+			return nil, errors.New("invalid argon2id hash")
+		}
+		h := &argon2Hash{}
+		if _, err := fmt.Sscanf(f[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+			return nil, errors.Wrap(err, "invalid argon2id parameters")
+		}
+		var err error
+		if h.salt, err = base64.RawStdEncoding.DecodeString(f[4]); err != nil {
+			return nil, errors.Wrap(err, "invalid argon2id salt")
+		}
+		if h.sum, err = base64.RawStdEncoding.DecodeString(f[5]); err != nil || len(h.sum) == 0 {
+			return nil, errors.New("invalid argon2id hash")
+		}
+		if err := h.validate(); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	return nil, errors.New("unsupported hash. sha256:<hex> or $argon2id$... is required")
+}
+
+// keySet keys indexed so that a request is checked against at most one argon2id hash
+type keySet struct {
+	// sha256 keys by the sum
+	bySum map[[sha256.Size]byte]*Key
+	// argon2id keys by the id
+	byID map[string]*Key
+}
+
+func (ks *keySet) len() int {
+	return len(ks.bySum) + len(ks.byID)
+}
+
+// Keys API keys loaded from a file
+type Keys struct {
+	file   string
+	logger *zap.Logger
+	mu     sync.RWMutex
+	keys   *keySet
+	// argon2 limits concurrent argon2id hashes
+	argon2 chan struct{}
+}
+
+// New load API keys file
+func New(file string, logger *zap.Logger) (*Keys, error) {
+	k := &Keys{file: file, logger: logger, argon2: make(chan struct{}, maxArgon2Checks)}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload read the file again. The current keys are kept on error
+func (k *Keys) Reload() error {
+	b, err := os.ReadFile(k.file)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read API keys file")
+	}
+	keys, err := parse(b)
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse API keys file")
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	k.logger.Info("Loaded API keys", zap.String("api_keys", k.file), zap.Int("keys", keys.len()))
+	return nil
+}
+
+func parse(b []byte) (*keySet, error) {
+	var kf keysFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&kf); err != nil && err != io.EOF {
+		return nil, err
+	}
+	names := make(map[string]struct{})
+	keys := &keySet{
+		bySum: make(map[[sha256.Size]byte]*Key),
+		byID:  make(map[string]*Key),
+	}
+	for i, kc := range kf.Keys {
+		if kc.Name == "" {
+			return nil, errors.Errorf("empty name of key #%d", i+1)
+		}
+		if _, ok := names[kc.Name]; ok {
+			return nil, errors.Errorf("duplicated name: %s", kc.Name)
+		}
+		names[kc.Name] = struct{}{}
+		if len(kc.Destinations) == 0 {
+			return nil, errors.Errorf("no destinations of key %s", kc.Name)
+		}
+		h, err := parseHash(kc.Hash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key %s", kc.Name)
+		}
+		key := &Key{Name: kc.Name, Destinations: kc.Destinations, hash: h}
+		switch h := h.(type) {
+		case sha256Hash:
+			var sum [sha256.Size]byte
+			copy(sum[:], h)
+			if _, ok := keys.bySum[sum]; ok {
+				return nil, errors.Errorf("duplicated hash of key %s", kc.Name)
+			}
+			if kc.ID != "" {
+				return nil, errors.Errorf("id of key %s is only for argon2id hashes", kc.Name)
+			}
+			keys.bySum[sum] = key
+		default:
+			// the id is not a secret but selects the hash to compute, so it must be
+			// random rather than the name which is logged
+			key.ID = kc.ID
+			if len(key.ID) < minIDLen {
+				return nil, errors.Errorf("id of key %s must be a random string of at least %d characters", kc.Name, minIDLen)
+			}
+			if key.ID == kc.Name {
+				return nil, errors.Errorf("id of key %s must not be the name", kc.Name)
+			}
+			if strings.Contains(key.ID, IDSeparator) {
+				return nil, errors.Errorf("id of key %s must not contain %q", kc.Name, IDSeparator)
+			}
+			if _, ok := keys.byID[key.ID]; ok {
+				return nil, errors.Errorf("duplicated id: %s", key.ID)
+			}
+			keys.byID[key.ID] = key
+		}
+	}
+	return keys, nil
+}
+
+// Present the Authorization header has an API key
+func Present(authorization string) bool {
+	return strings.HasPrefix(authorization, Scheme+" ")
+}
+
+// Verify API key in Authorization header "ApiKey <key>". sha256 keys are looked up by
+// the sum, and keys hashed by argon2id by the id prefix "<id>.", so that at most one
+// argon2id runs for a request. Requests over maxArgon2Checks argon2id at once are rejected
+func (k *Keys) Verify(authorization string) (*Key, error) {
+	key, ok := strings.CutPrefix(authorization, Scheme+" ")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return nil, errors.New("no API key")
+	}
+	k.mu.RLock()
+	keys := k.keys
+	k.mu.RUnlock()
+	if c, ok := keys.bySum[sha256.Sum256([]byte(key))]; ok {
+		return c, nil
+	}
+	if id, _, ok := strings.Cut(key, IDSeparator); ok {
+		if c, ok := keys.byID[id]; ok {
+			select {
+			case k.argon2 <- struct{}{}:
+			default:
+				return nil, errors.New("too many API key checks in progress")
+			}
+			match := c.hash.match(key)
+			<-k.argon2
+			if match {
+				return c, nil
+			}
+		}
+	}
+	return nil, errors.New("unknown API key")
+}
+
+// Authenticate verify the API key in Authorization header. Implements auth.Authenticator
+func (k *Keys) Authenticate(r *http.Request) (*auth.Identity, error) {
+	authorization := r.Header.Get("Authorization")
+	if !Present(authorization) {
+		return nil, auth.ErrNoCredentials
+	}
+	key, err := k.Verify(authorization)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Identity{
+		Method:       AuthMethod,
+		Subject:      key.Name,
+		Destinations: key.Destinations,
+	}, nil
+}
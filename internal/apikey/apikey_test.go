@@ -0,0 +1,121 @@
+package apikey
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+)
+
+func sha256Of(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func argon2Of(key string) string {
+	salt := []byte("0123456789abcdef")
+	sum := argon2.IDKey([]byte(key), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(sum))
+}
+
+func writeKeys(t *testing.T, body string) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "keys.yaml")
+	assert.NoError(t, os.WriteFile(f, []byte(body), 0o644))
+	return f
+}
+
+func TestVerify(t *testing.T) {
+	f := writeKeys(t, fmt.Sprintf(`
+keys:
+  - name: ci-deploy
+    hash: %s
+    destinations: [mysql, ssh]
+  - name: backup
+    id: 7c1e9b3a05d4
+    hash: "%s"
+    destinations: ["*"]
+  - name: report
+    id: 0f8e2d6a91b3
+    hash: "%s"
+    destinations: [mysql]
+`, sha256Of("secret-1"), argon2Of("7c1e9b3a05d4.secret-2"), argon2Of("0f8e2d6a91b3.secret-3")))
+	keys, err := New(f, zap.NewNop())
+	assert.NoError(t, err)
+
+	k, err := keys.Verify("ApiKey secret-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci-deploy", k.Name)
+	assert.True(t, k.Allow("mysql"))
+	assert.False(t, k.Allow("redis"))
+
+	k, err = keys.Verify("ApiKey 7c1e9b3a05d4.secret-2")
+	assert.NoError(t, err)
+	assert.Equal(t, "backup", k.Name)
+	assert.True(t, k.Allow("redis"))
+
+	k, err = keys.Verify("ApiKey 0f8e2d6a91b3.secret-3")
+	assert.NoError(t, err)
+	assert.Equal(t, "report", k.Name)
+
+	for _, key := range []string{"secret-2", "backup.secret-2", "7c1e9b3a05d4.secret-3", "report.secret-3", "secret-4"} {
+		_, err = keys.Verify("ApiKey " + key)
+		assert.EqualError(t, err, "unknown API key", key)
+	}
+	_, err = keys.Verify("ApiKey ")
+	assert.EqualError(t, err, "no API key")
+
+	// argon2id checks over the limit are rejected
+	for i := 0; i < cap(keys.argon2); i++ {
+		keys.argon2 <- struct{}{}
+	}
+	_, err = keys.Verify("ApiKey 7c1e9b3a05d4.secret-2")
+	assert.EqualError(t, err, "too many API key checks in progress")
+	k, err = keys.Verify("ApiKey secret-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci-deploy", k.Name)
+	_, err = keys.Verify("Bearer secret-1")
+	assert.EqualError(t, err, "no API key")
+
+	assert.True(t, Present("ApiKey secret-1"))
+	assert.False(t, Present("Bearer secret-1"))
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"no name", "keys:\n  - hash: " + sha256Of("a") + "\n    destinations: [a]\n", "empty name"},
+		{"duplicated", "keys:\n  - {name: a, hash: " + sha256Of("a") + ", destinations: [a]}\n  - {name: a, hash: " + sha256Of("b") + ", destinations: [a]}\n", "duplicated name"},
+		{"no destinations", "keys:\n  - {name: a, hash: " + sha256Of("a") + "}\n", "no destinations"},
+		{"plain key", "keys:\n  - {name: a, hash: secret, destinations: [a]}\n", "unsupported hash"},
+		{"short sha256", "keys:\n  - {name: a, hash: 'sha256:abcd', destinations: [a]}\n", "invalid sha256 hash"},
+		{"argon2i", "keys:\n  - {name: a, hash: '$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA', destinations: [a]}\n", "unsupported hash"},
+		{"argon2id t=0", "keys:\n  - {name: a, hash: '$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHQ$" + strings.Repeat("A", 43) + "', destinations: [a]}\n", "t must be"},
+		{"argon2id p=0", "keys:\n  - {name: a, hash: '$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHQ$" + strings.Repeat("A", 43) + "', destinations: [a]}\n", "p must be"},
+		{"argon2id huge m", "keys:\n  - {name: a, hash: '$argon2id$v=19$m=4194304,t=1,p=1$c2FsdHNhbHQ$" + strings.Repeat("A", 43) + "', destinations: [a]}\n", "m must be"},
+		{"argon2id short hash", "keys:\n  - {name: a, hash: '$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$aGFzaA', destinations: [a]}\n", "hash must be"},
+		{"no id", "keys:\n  - {name: backup-key, hash: '" + argon2Of("backup-key.x") + "', destinations: [a]}\n", "must be a random string"},
+		{"short id", "keys:\n  - {name: a, id: r1, hash: '" + argon2Of("r1.x") + "', destinations: [a]}\n", "must be a random string"},
+		{"id of the name", "keys:\n  - {name: backup-key, id: backup-key, hash: '" + argon2Of("backup-key.x") + "', destinations: [a]}\n", "must not be the name"},
+		{"id with separator", "keys:\n  - {name: a, id: 0f8e2d6a.91b3, hash: '" + argon2Of("0f8e2d6a.91b3.c") + "', destinations: [a]}\n", "must not contain"},
+		{"duplicated id", "keys:\n  - {name: a, id: 0f8e2d6a91b3, hash: '" + argon2Of("0f8e2d6a91b3.x") + "', destinations: [a]}\n  - {name: b, id: 0f8e2d6a91b3, hash: '" + argon2Of("0f8e2d6a91b3.y") + "', destinations: [a]}\n", "duplicated id"},
+		{"id of sha256", "keys:\n  - {name: a, id: a, hash: " + sha256Of("a") + ", destinations: [a]}\n", "only for argon2id"},
+		{"unknown field", "keys:\n  - {name: a, hash: " + sha256Of("a") + ", destinations: [a], scope: b}\n", "not found"},
+	}
+	for _, tt := range tests {
+		_, err := New(writeKeys(t, tt.body), zap.NewNop())
+		assert.ErrorContains(t, err, tt.err, tt.name)
+	}
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoCredentials the request has no credentials for the authenticator
+var ErrNoCredentials = errors.New("no credentials")
+
+// Identity authenticated user
+type Identity struct {
+	// Method name of the authentication method, such as "jwt"
+	Method  string
+	Subject string
+	Email   string
+	Groups  []string
+	// Claims all claims or attributes of the credentials
+	Claims map[string]interface{}
+
+	// ID of the credentials, such as jti
+	ID        string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+
+	// Destinations the identity may use. nil means all
+	Destinations []string
+	// Subprotocol WebSocket subprotocol to answer
+	Subprotocol string
+}
+
+// AllowDestination the identity may use dest
+func (id *Identity) AllowDestination(dest string) bool {
+	if id.Destinations == nil {
+		return true
+	}
+	for _, d := range id.Destinations {
+		if d == dest || d == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator authenticates requests
+type Authenticator interface {
+	// Authenticate returns ErrNoCredentials if the request has no credentials for it,
+	// and other errors if the credentials are invalid
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Revoker authenticators whose identities can be revoked after authentication
+type Revoker interface {
+	// Revoked returns an error if id is revoked now
+	Revoked(id *Identity) error
+}
+
+// Chain tries authenticators in order. The first one the request has credentials for decides
+type Chain []Authenticator
+
+// Authenticate implements Authenticator
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// Revoked implements Revoker with the authenticators implementing Revoker
+func (c Chain) Revoked(id *Identity) error {
+	for _, a := range c {
+		if rv, ok := a.(Revoker); ok {
+			if err := rv.Revoked(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ClaimStrings claim of an array of strings or a space separated string
+func ClaimStrings(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []string:
+		return v
+	case []interface{}:
+		var ss []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
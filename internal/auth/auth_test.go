@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type headerAuthenticator struct {
+	header string
+}
+
+func (a headerAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	v := r.Header.Get(a.header)
+	switch v {
+	case "":
+		return nil, ErrNoCredentials
+	case "invalid":
+		return nil, errors.New("invalid " + a.header)
+	}
+	return &Identity{Method: a.header, Subject: v}, nil
+}
+
+func (a headerAuthenticator) Revoked(id *Identity) error {
+	if id.Method == a.header && id.Subject == "revoked" {
+		return errors.New("revoked")
+	}
+	return nil
+}
+
+func TestChain(t *testing.T) {
+	c := Chain{headerAuthenticator{"X-First"}, headerAuthenticator{"X-Second"}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err := c.Authenticate(r)
+	assert.Equal(t, ErrNoCredentials, err)
+
+	r.Header.Set("X-Second", "bob")
+	id, err := c.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{Method: "X-Second", Subject: "bob"}, id)
+
+	r.Header.Set("X-First", "alice")
+	id, err = c.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", id.Subject)
+
+	// invalid credentials are not passed to the next
+	r.Header.Set("X-First", "invalid")
+	_, err = c.Authenticate(r)
+	assert.EqualError(t, err, "invalid X-First")
+
+	assert.NoError(t, c.Revoked(&Identity{Method: "X-First", Subject: "alice"}))
+	assert.EqualError(t, c.Revoked(&Identity{Method: "X-Second", Subject: "revoked"}), "revoked")
+}
+
+func TestIdentity(t *testing.T) {
+	assert.True(t, (&Identity{}).AllowDestination("mysql"))
+	id := &Identity{Destinations: []string{"mysql"}}
+	assert.True(t, id.AllowDestination("mysql"))
+	assert.False(t, id.AllowDestination("ssh"))
+	assert.True(t, (&Identity{Destinations: []string{"*"}}).AllowDestination("ssh"))
+	assert.False(t, (&Identity{Destinations: []string{}}).AllowDestination("ssh"))
+
+	claims := map[string]interface{}{
+		"scope":  "read write",
+		"groups": []interface{}{"dba", 1, "dev"},
+	}
+	assert.Equal(t, []string{"read", "write"}, ClaimStrings(claims, "scope"))
+	assert.Equal(t, []string{"dba", "dev"}, ClaimStrings(claims, "groups"))
+	assert.Nil(t, ClaimStrings(claims, "roles"))
+}
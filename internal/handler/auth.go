@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kazeburo/wsgate-server/internal/apikey"
+	"github.com/kazeburo/wsgate-server/internal/auth"
+	"github.com/kazeburo/wsgate-server/internal/publickey"
+	"github.com/pkg/errors"
+)
+
+// authentication methods
+const (
+	AuthClientCert = "client-cert"
+	AuthAPIKey     = apikey.AuthMethod
+	AuthJWT        = publickey.AuthMethod
+	AuthIAP        = "iap"
+	// AuthHeader trust X-Goog-Authenticated-User-Email. Used when no other method is configured,
+	// or when it is in the auth order. Every request has credentials for it, so it should be the last
+	AuthHeader = "header"
+)
+
+// DefaultAuthOrder order to try authentication methods
+var DefaultAuthOrder = []string{AuthClientCert, AuthAPIKey, AuthJWT, AuthIAP}
+
+// WithAPIKeys authenticate requests with "Authorization: ApiKey <key>" by keys
+func WithAPIKeys(keys *apikey.Keys) Option {
+	return func(h *Handler) {
+		h.apiKeys = keys
+	}
+}
+
+// WithAuthOrder order to try authentication methods. A method is skipped when it is not
+// configured or the request has no credentials for it. See DefaultAuthOrder
+func WithAuthOrder(order []string) Option {
+	return func(h *Handler) {
+		if len(order) > 0 {
+			h.authOrder = order
+		}
+	}
+}
+
+// WithAuthenticator authenticate requests with a instead of the built-in methods.
+// Sessions are closed by CloseRevoked if a implements auth.Revoker
+func WithAuthenticator(a auth.Authenticator) Option {
+	return func(h *Handler) {
+		h.auth = a
+	}
+}
+
+// authenticators built-in methods in authOrder
+func (h *Handler) authenticators() (auth.Chain, error) {
+	var c auth.Chain
+	for _, m := range h.authOrder {
+		switch m {
+		case AuthClientCert:
+			if h.clientIdentity != "" {
+				c = append(c, &clientCertAuthenticator{identity: h.clientIdentity})
+			}
+		case AuthAPIKey:
+			if h.apiKeys != nil {
+				c = append(c, h.apiKeys)
+			}
+		case AuthJWT:
+			if h.jwtEnabled() {
+				c = append(c, &tokenAuthenticator{
+					pk:          h.pk,
+					queryParam:  h.tokenQueryParam,
+					subprotocol: h.tokenSubprotocol,
+				})
+			}
+		case AuthIAP:
+			if h.iap != nil {
+				c = append(c, &iapAuthenticator{iap: h.iap})
+			}
+		case AuthHeader:
+			c = append(c, headerAuthenticator{})
+		default:
+			return nil, fmt.Errorf("unknown authentication method: %s", m)
+		}
+	}
+	// without any configured method, trust the header as ever
+	if len(c) == 0 {
+		c = append(c, headerAuthenticator{})
+	}
+	return c, nil
+}
+
+func (h *Handler) jwtEnabled() bool {
+	return h.pk != nil && h.pk.Enabled()
+}
+
+// iapAuthenticator verifies the signed header of Google Cloud IAP
+type iapAuthenticator struct {
+	iap *publickey.Publickey
+}
+
+// Authenticate the user is the email of the assertion. ExpiresAt is not set,
+// as assertions are renewed by IAP for each request but not for the session
+func (a *iapAuthenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	assertion := r.Header.Get(publickey.IAPHeader)
+	if assertion == "" {
+		return nil, auth.ErrNoCredentials
+	}
+	claims, err := a.iap.Verify(assertion)
+	if err != nil {
+		return nil, err
+	}
+	email, _ := claims.Raw["email"].(string)
+	if email == "" {
+		return nil, errors.New("no email in IAP assertion")
+	}
+	return &auth.Identity{
+		Method: AuthIAP,
+		// same form as X-Goog-Authenticated-User-Email
+		Subject: "accounts.google.com:" + email,
+		Email:   email,
+		Claims:  claims.Raw,
+		ID:      claims.ID,
+	}, nil
+}
+
+// headerAuthenticator trusts X-Goog-Authenticated-User-Email
+type headerAuthenticator struct{}
+
+// Authenticate the request always has credentials, which may be empty
+func (headerAuthenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	email := r.Header.Get("X-Goog-Authenticated-User-Email")
+	return &auth.Identity{
+		Method:  AuthHeader,
+		Subject: email,
+		Email:   strings.TrimPrefix(email, "accounts.google.com:"),
+	}, nil
+}
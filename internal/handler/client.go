@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientAddr address of the client. X-Forwarded-For is used only when the
+// request comes from a trusted proxy, and its rightmost untrusted entry is the client.
+// The port is 0 if the address is taken from X-Forwarded-For
+func (h *Handler) clientAddr(r *http.Request) *net.TCPAddr {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	addr := &net.TCPAddr{IP: ap.Addr().Unmap().AsSlice(), Port: int(ap.Port())}
+	if !h.trusted(ap.Addr()) {
+		return addr
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = &net.TCPAddr{IP: ip.Unmap().AsSlice()}
+		if !h.trusted(ip) {
+			break
+		}
+	}
+	return addr
+}
+
+func (h *Handler) trusted(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range h.trustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kazeburo/wsgate-server/internal/auth"
+)
+
+// identity of a client certificate
+const (
+	ClientIdentityCN      = "cn"
+	ClientIdentitySubject = "subject"
+	ClientIdentityEmail   = "email"
+	ClientIdentityDNS     = "dns"
+	ClientIdentityURI     = "uri"
+)
+
+// WithClientCert identify users by verified TLS client certificates. identity is
+// the field of the certificate used as the user: cn, subject, or the first email,
+// dns or uri SAN. Requests without a verified certificate are authenticated as without this option
+func WithClientCert(identity string) Option {
+	return func(h *Handler) {
+		h.clientIdentity = identity
+	}
+}
+
+func validClientIdentity(identity string) bool {
+	switch identity {
+	case ClientIdentityCN, ClientIdentitySubject, ClientIdentityEmail, ClientIdentityDNS, ClientIdentityURI:
+		return true
+	}
+	return false
+}
+
+// clientCert verified client certificate of the request
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// clientCertAuthenticator verified TLS client certificates
+type clientCertAuthenticator struct {
+	identity string
+}
+
+// Authenticate Email is the first email SAN and Groups are the organizational units
+func (a *clientCertAuthenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	cert := clientCert(r)
+	if cert == nil {
+		return nil, auth.ErrNoCredentials
+	}
+	var subject string
+	switch a.identity {
+	case ClientIdentityCN:
+		subject = cert.Subject.CommonName
+	case ClientIdentitySubject:
+		subject = cert.Subject.String()
+	case ClientIdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			subject = cert.EmailAddresses[0]
+		}
+	case ClientIdentityDNS:
+		if len(cert.DNSNames) > 0 {
+			subject = cert.DNSNames[0]
+		}
+	case ClientIdentityURI:
+		if len(cert.URIs) > 0 {
+			subject = cert.URIs[0].String()
+		}
+	}
+	if strings.TrimSpace(subject) == "" {
+		return nil, fmt.Errorf("no %s in client certificate", a.identity)
+	}
+	id := &auth.Identity{
+		Method:  AuthClientCert,
+		Subject: subject,
+		Groups:  cert.Subject.OrganizationalUnit,
+	}
+	if len(cert.EmailAddresses) > 0 {
+		id.Email = cert.EmailAddresses[0]
+	}
+	return id, nil
+}
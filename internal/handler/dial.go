@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kazeburo/wsgate-server/internal/mapping"
+	"github.com/kazeburo/wsgate-server/internal/proxyproto"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// dial connect to the candidates of dest in order until one succeeds, within
+// the attempt and time budget. The returned upstream is acquired and must be released
+func (h *Handler) dial(dest *mapping.Destination, key mapping.SelectKey, preface []byte, logger *zap.Logger) (*mapping.Upstream, net.Conn, error) {
+	dialTimeout := dest.GetDialTimeout(h.dialTimeout)
+	attempts := dest.GetDialAttempts(h.dialAttempts)
+	totalTimeout := dest.GetDialTotalTimeout(h.dialTotalTimeout)
+
+	var deadline time.Time
+	if totalTimeout > 0 {
+		deadline = time.Now().Add(totalTimeout)
+	}
+
+	candidates := dest.Candidates(key)
+	if len(candidates) == 0 {
+		return nil, nil, mapping.ErrNoHealthyUpstream
+	}
+
+	var lastErr error
+	for i, u := range candidates {
+		if i >= attempts {
+			break
+		}
+		timeout := dialTimeout
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				lastErr = errors.Errorf("dial total timeout %s exceeded", totalTimeout)
+				break
+			}
+			if remaining < timeout {
+				timeout = remaining
+			}
+		}
+		u.Acquire()
+		s, err := dialUpstream(dest, u, timeout, preface)
+		if err == nil {
+			return u, s, nil
+		}
+		u.Release()
+		lastErr = err
+		logger.Warn("DialTimeout",
+			zap.String("upstream", u.String()),
+			zap.Int("attempt", i+1),
+			zap.Error(err))
+		h.reportFailure(u, "dial", logger)
+	}
+	return nil, nil, lastErr
+}
+
+// dialUpstream connect to u, send preface and start TLS if the destination requires it
+func dialUpstream(dest *mapping.Destination, u *mapping.Upstream, timeout time.Duration, preface []byte) (net.Conn, error) {
+	start := time.Now()
+	s, err := net.DialTimeout(u.Network, u.Address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(preface) > 0 {
+		// timeout 0 means no limit as net.DialTimeout
+		if timeout > 0 {
+			s.SetWriteDeadline(start.Add(timeout))
+		}
+		if _, err := s.Write(preface); err != nil {
+			s.Close()
+			return nil, errors.Wrap(err, "PROXY protocol header")
+		}
+		s.SetWriteDeadline(time.Time{})
+	}
+	cfg := dest.TLSConfig()
+	if cfg == nil {
+		return s, nil
+	}
+	if cfg.ServerName == "" && u.Network == "tcp" {
+		cfg.ServerName, _, _ = net.SplitHostPort(u.Address)
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout-time.Since(start))
+		defer cancel()
+	}
+	tc := tls.Client(s, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		s.Close()
+		return nil, errors.Wrap(err, "TLS handshake")
+	}
+	return tc, nil
+}
+
+// proxyHeader PROXY protocol header for the destination, or nil if disabled
+func proxyHeader(dest *mapping.Destination, r *http.Request, client *net.TCPAddr, user string) ([]byte, error) {
+	if dest.ProxyProtocol == 0 {
+		return nil, nil
+	}
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	h := &proxyproto.Header{
+		Version:     dest.ProxyProtocol,
+		Source:      client,
+		Destination: local,
+	}
+	if user != "" {
+		h.TLVs = append(h.TLVs, proxyproto.TLV{Type: proxyproto.TLVUser, Value: []byte(user)})
+	}
+	h.TLVs = append(h.TLVs, proxyproto.TLV{Type: proxyproto.TLVDestination, Value: []byte(dest.Name)})
+	return h.Format()
+}
+
+// reportSession feed the result of a finished session to outlier detection.
+// A session closed by the upstream right after connecting counts as a failure
+func (h *Handler) reportSession(u *mapping.Upstream, disconnectAt string, elapsed time.Duration, logger *zap.Logger) {
+	if h.outlierFailures <= 0 {
+		return
+	}
+	if disconnectAt == "upstream_read" && elapsed < h.outlierEarlyDisconnect {
+		h.reportFailure(u, "early_disconnect", logger)
+		return
+	}
+	u.ReportSuccess()
+}
+
+func (h *Handler) reportFailure(u *mapping.Upstream, reason string, logger *zap.Logger) {
+	ejection := u.ReportFailure(h.outlierFailures, h.outlierEjectionTime)
+	if ejection > 0 {
+		logger.Warn("Upstream is ejected",
+			zap.String("upstream", u.String()),
+			zap.String("reason", reason),
+			zap.Int("consecutive_failures", h.outlierFailures),
+			zap.Duration("ejection_time", ejection))
+	}
+}
@@ -1,16 +1,19 @@
 package handler
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/kazeburo/wsgate-server/internal/apikey"
+	"github.com/kazeburo/wsgate-server/internal/auth"
 	"github.com/kazeburo/wsgate-server/internal/dumper"
 	"github.com/kazeburo/wsgate-server/internal/mapping"
 	"github.com/kazeburo/wsgate-server/internal/publickey"
@@ -28,14 +31,80 @@ var (
 
 // Handler handlers
 type Handler struct {
-	logger       *zap.Logger
-	upgrader     websocket.Upgrader
-	dialTimeout  time.Duration
-	writeTimeout time.Duration
-	mp           *mapping.Mapping
-	pk           *publickey.Publickey
-	dumpTCP      uint
-	sq           *uint64
+	logger           *zap.Logger
+	upgrader         websocket.Upgrader
+	dialTimeout      time.Duration
+	dialAttempts     int
+	dialTotalTimeout time.Duration
+	writeTimeout     time.Duration
+
+	outlierFailures        int
+	outlierEjectionTime    time.Duration
+	outlierEarlyDisconnect time.Duration
+	trustedProxies         []netip.Prefix
+	tokenQueryParam        string
+	tokenSubprotocol       bool
+	expireSession          bool
+	expireGrace            time.Duration
+	reauth                 bool
+	clientIdentity         string
+	apiKeys                *apikey.Keys
+	authOrder              []string
+	auth                   auth.Authenticator
+	pingInterval           time.Duration
+	pongWait               time.Duration
+	readTimeout            time.Duration
+	idleTimeout            time.Duration
+	maxLifetime            time.Duration
+
+	mp      *mapping.Mapping
+	pk      *publickey.Publickey
+	iap     *publickey.Publickey
+	dumpTCP uint
+	sq      *uint64
+
+	sessionsMu sync.Mutex
+	sessions   map[*session]struct{}
+}
+
+// Option optional settings of Handler
+type Option func(*Handler)
+
+// WithDialFailover try up to attempts upstreams of a pool within totalTimeout.
+// totalTimeout 0 means no limit other than dial timeout of each attempt
+func WithDialFailover(attempts int, totalTimeout time.Duration) Option {
+	return func(h *Handler) {
+		if attempts > 0 {
+			h.dialAttempts = attempts
+		}
+		h.dialTotalTimeout = totalTimeout
+	}
+}
+
+// WithOutlierDetection eject an upstream for ejectionTime after consecutiveFailures
+// dial errors or sessions closed by the upstream within earlyDisconnect
+func WithOutlierDetection(consecutiveFailures int, ejectionTime, earlyDisconnect time.Duration) Option {
+	return func(h *Handler) {
+		h.outlierFailures = consecutiveFailures
+		h.outlierEjectionTime = ejectionTime
+		h.outlierEarlyDisconnect = earlyDisconnect
+	}
+}
+
+// WithTrustedProxies trust X-Forwarded-For of requests from these networks
+// to find the client address
+func WithTrustedProxies(prefixes []netip.Prefix) Option {
+	return func(h *Handler) {
+		h.trustedProxies = prefixes
+	}
+}
+
+// WithIAP identify users by the signed header of Google Cloud IAP verified
+// with iap, instead of X-Goog-Authenticated-User-Email. See publickey.NewIAP
+func WithIAP(iap *publickey.Publickey) Option {
+	return func(h *Handler) {
+		h.iap = iap
+	}
 }
 
 // New new handler
@@ -47,7 +116,8 @@ func New(
 	mp *mapping.Mapping,
 	pk *publickey.Publickey,
 	dumpTCP uint,
-	logger *zap.Logger) (*Handler, error) {
+	logger *zap.Logger,
+	opts ...Option) (*Handler, error) {
 
 	upgrader := websocket.Upgrader{
 		EnableCompression: enableCompression,
@@ -60,22 +130,50 @@ func New(
 	}
 
 	seq := uint64(0)
-	return &Handler{
+	h := &Handler{
 		logger:       logger,
 		upgrader:     upgrader,
 		dialTimeout:  dialTimeout,
+		dialAttempts: 1,
 		writeTimeout: writeTimeout,
 		mp:           mp,
 		pk:           pk,
 		dumpTCP:      dumpTCP,
 		sq:           &seq,
-	}, nil
+		sessions:     make(map[*session]struct{}),
+		authOrder:    DefaultAuthOrder,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.auth == nil {
+		c, err := h.authenticators()
+		if err != nil {
+			return nil, err
+		}
+		h.auth = c
+	}
+	if h.pingInterval > 0 && h.pongWait <= h.pingInterval {
+		return nil, fmt.Errorf("pong wait %s must be longer than ping interval %s", h.pongWait, h.pingInterval)
+	}
+	if h.clientIdentity != "" && !validClientIdentity(h.clientIdentity) {
+		return nil, fmt.Errorf("unknown client certificate identity: %s", h.clientIdentity)
+	}
+	return h, nil
 }
 
 func (h *Handler) GetSq() uint64 {
 	return atomic.LoadUint64(h.sq)
 }
 
+// writeDeadline deadline of a write starting now. timeout 0 means no deadline
+func writeDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
 // Hello hello handler
 func (h *Handler) Hello() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -83,6 +181,14 @@ func (h *Handler) Hello() func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Upstreams upstream status handler
+func (h *Handler) Upstreams() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.mp.Status())
+	}
+}
+
 // Proxy proxy handler
 func (h *Handler) Proxy(wg *sync.WaitGroup) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -91,7 +197,6 @@ func (h *Handler) Proxy(wg *sync.WaitGroup) func(w http.ResponseWriter, r *http.
 
 		vars := mux.Vars(r)
 		proxyDest := vars["dest"]
-		upstream := ""
 		readLen := int64(0)
 		writeLen := int64(0)
 		hasError := false
@@ -104,20 +209,20 @@ func (h *Handler) Proxy(wg *sync.WaitGroup) func(w http.ResponseWriter, r *http.
 			zap.String("destination", proxyDest),
 		)
 
-		if h.pk.Enabled() {
-			sub, err := h.pk.Verify(r.Header.Get("Authorization"))
-			if err != nil {
-				logger.Warn("Failed to authorize", zap.Error(err))
-				http.Error(w, err.Error(), http.StatusUnauthorized)
-				return
-			}
-			logger = logger.With(zap.String("user-email", sub))
-
-		} else {
-			logger = logger.With(zap.String("user-email", r.Header.Get("X-Goog-Authenticated-User-Email")))
+		id, err := h.auth.Authenticate(r)
+		if err != nil {
+			logger.Warn("Failed to authorize", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var responseHeader http.Header
+		if id.Subprotocol != "" {
+			responseHeader = http.Header{"Sec-Websocket-Protocol": {id.Subprotocol}}
 		}
+		user := id.Subject
+		logger = logger.With(zap.String("user-email", user), zap.String("auth", id.Method))
 
-		upstream, ok := h.mp.Get(proxyDest)
+		dest, ok := h.mp.Get(proxyDest)
 		if !ok {
 			hasError = true
 			logger.Warn("No map found")
@@ -125,18 +230,62 @@ func (h *Handler) Proxy(wg *sync.WaitGroup) func(w http.ResponseWriter, r *http.
 			return
 		}
 
-		logger = logger.With(zap.String("upstream", upstream))
+		if !id.AllowDestination(proxyDest) {
+			hasError = true
+			logger.Warn("Forbidden by destination scope")
+			http.Error(w, fmt.Sprintf("Forbidden: %s", proxyDest), http.StatusForbidden)
+			return
+		}
 
-		s, err := net.DialTimeout("tcp", upstream, h.dialTimeout)
+		if rule, ok := dest.Authorize(id); !ok {
+			hasError = true
+			logger.Warn("Forbidden by authorization rule", zap.String("rule", rule))
+			http.Error(w, fmt.Sprintf("Forbidden: %s", proxyDest), http.StatusForbidden)
+			return
+		}
+
+		client := h.clientAddr(r)
+		clientIP := ""
+		if client != nil {
+			clientIP = client.IP.String()
+		}
+		preface, err := proxyHeader(dest, r, client, user)
+		if err != nil {
+			hasError = true
+			logger.Warn("Failed to build PROXY protocol header", zap.Error(err))
+			http.Error(w, fmt.Sprintf("Could not connect upstream: %v", err), 500)
+			return
+		}
 
+		upstream, s, err := h.dial(dest, mapping.SelectKey{
+			User:     user,
+			ClientIP: clientIP,
+		}, preface, logger)
+		if err == mapping.ErrNoHealthyUpstream {
+			hasError = true
+			logger.Warn("No healthy upstream")
+			http.Error(w, fmt.Sprintf("Service unavailable: %s", proxyDest), http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil {
 			hasError = true
-			logger.Warn("DialTimeout", zap.Error(err))
+			logger.Warn("Failed to connect any upstream", zap.Error(err))
 			http.Error(w, fmt.Sprintf("Could not connect upstream: %v", err), 500)
 			return
 		}
+		defer upstream.Release()
+		connectedAt := time.Now()
+		writeTimeout := dest.GetWriteTimeout(h.writeTimeout)
+		readTimeout := dest.GetReadTimeout(h.readTimeout)
+		logger = logger.With(
+			zap.String("upstream", upstream.String()),
+			zap.String("upstream-network", upstream.Network),
+			zap.Bool("upstream-tls", dest.TLSEnabled()),
+		)
 
-		conn, err := h.upgrader.Upgrade(w, r, nil)
+		upgrader := h.upgrader
+		upgrader.EnableCompression = dest.GetCompression(h.upgrader.EnableCompression)
+		conn, err := upgrader.Upgrade(w, r, responseHeader)
 		if err != nil {
 			hasError = true
 			s.Close()
@@ -147,12 +296,16 @@ func (h *Handler) Proxy(wg *sync.WaitGroup) func(w http.ResponseWriter, r *http.
 		logger.Info("log", zap.String("status", "Connected"))
 		dr := dumper.New(websocketUpstream, logger)
 		ds := dumper.New(upstreamWebsocket, logger)
+		sess := newSession(conn, s, id, logger)
+		h.register(sess)
+		defer h.unregister(sess)
 
 		defer func() {
 			dr.Flush()
 			ds.Flush()
+			disconnectAt = sess.disconnectReason()
 			status := "Suceeded"
-			if hasError {
+			if hasError || sess.hasFailed() {
 				status = "Failed"
 			}
 			logger.Info("log",
@@ -161,6 +314,7 @@ func (h *Handler) Proxy(wg *sync.WaitGroup) func(w http.ResponseWriter, r *http.
 				zap.Int64("write", writeLen),
 				zap.String("disconnect_at", disconnectAt),
 			)
+			h.reportSession(upstream, disconnectAt, time.Since(connectedAt), logger)
 		}()
 
 		ticker := time.NewTicker(flushDumperInterval * time.Millisecond)
@@ -179,13 +333,44 @@ func (h *Handler) Proxy(wg *sync.WaitGroup) func(w http.ResponseWriter, r *http.
 			}
 		}()
 
+		var expiry *time.Timer
+		if h.expireSession && !id.ExpiresAt.IsZero() {
+			expiry = h.expireAt(sess, id.ExpiresAt, logger)
+			defer expiry.Stop()
+		}
+
+		pongWait := time.Duration(0)
+		if h.pingInterval > 0 {
+			pongWait = h.pongWait
+			stopPing := make(chan struct{})
+			defer close(stopPing)
+			h.startKeepalive(conn, writeTimeout, stopPing, logger)
+		}
+
+		if idleTimeout := dest.GetIdleTimeout(h.idleTimeout); idleTimeout > 0 {
+			idle := closeIdle(sess, idleTimeout, logger)
+			defer idle.Stop()
+		}
+		if maxLifetime := dest.GetMaxLifetime(h.maxLifetime); maxLifetime > 0 {
+			lifetime := closeAfter(sess, maxLifetime, logger)
+			defer lifetime.Stop()
+		}
+
 		doneCh := make(chan bool)
-		goClose := false
 
 		// websocket -> server
 		go func() {
 			defer func() { doneCh <- true }()
 			b := make([]byte, BufferSize)
+			deadline := newClientDeadline(conn, pongWait, readTimeout)
+			uw := &deadlineWriter{conn: s, timeout: writeTimeout}
+			readTimedOut := func(err error) {
+				if isTimeout(err) && !sess.isTerminated() {
+					reason, text := deadline.expired()
+					logger.Warn("Client read timeout. Close session", zap.String("reason", reason))
+					sess.terminate(reason, websocket.CloseGoingAway, text)
+				}
+			}
 			for {
 				mt, r, err := conn.NextReader()
 				if websocket.IsCloseError(err,
@@ -195,35 +380,52 @@ func (h *Handler) Proxy(wg *sync.WaitGroup) func(w http.ResponseWriter, r *http.
 					return
 				}
 				if err != nil {
-					if !goClose {
+					readTimedOut(err)
+					if !sess.isTerminated() {
 						logger.Warn("NextReader", zap.Error(err))
-						hasError = true
-					}
-					if disconnectAt == "" {
-						disconnectAt = "client_nextreader"
+						sess.fail()
 					}
+					sess.disconnect("client_nextreader")
 					return
 				}
+				if mt == websocket.TextMessage && expiry != nil && h.reauth && h.jwtEnabled() {
+					newID, err := h.reauthenticate(r, dest, user, expiry, logger)
+					if err != nil {
+						logger.Warn("Failed to re-authenticate", zap.Error(err))
+						sess.terminate("reauth_failed", websocket.ClosePolicyViolation, "re-authentication failed")
+						return
+					}
+					sess.setIdentity(newID)
+					logger.Info("Re-authenticated", zap.Time("expires_at", newID.ExpiresAt))
+					deadline.message()
+					continue
+				}
 				if mt != websocket.BinaryMessage {
 					logger.Warn("BinaryMessage required", zap.Int("messageType", mt))
-					hasError = true
+					sess.fail()
 					return
 				}
 				if h.dumpTCP > 0 {
 					r = io.TeeReader(r, dr)
 				}
-				n, err := io.CopyBuffer(s, r, b)
+				n, err := io.CopyBuffer(uw, r, b)
 				if err != nil {
-					if !goClose {
-						logger.Warn("Reading from websocket", zap.Error(err))
-						hasError = true
+					if err == uw.err && isTimeout(err) && !sess.isTerminated() {
+						logger.Warn("Upstream write timeout. Close session", zap.Duration("write_timeout", writeTimeout))
+						sess.terminate("upstream_write_timeout", websocket.CloseGoingAway, "upstream write timeout")
+					} else if err != uw.err {
+						readTimedOut(err)
 					}
-					if disconnectAt == "" {
-						disconnectAt = "client_upstream_copy"
+					if !sess.isTerminated() {
+						logger.Warn("Reading from websocket", zap.Error(err))
+						sess.fail()
 					}
+					sess.disconnect("client_upstream_copy")
 					return
 				}
 				readLen += n
+				sess.touch()
+				deadline.message()
 			}
 		}()
 
@@ -232,37 +434,46 @@ func (h *Handler) Proxy(wg *sync.WaitGroup) func(w http.ResponseWriter, r *http.
 			defer func() { doneCh <- true }()
 			b := make([]byte, BufferSize)
 			for {
+				if readTimeout > 0 {
+					s.SetReadDeadline(time.Now().Add(readTimeout))
+				}
 				n, err := s.Read(b)
 				if err != nil {
-					if !goClose && err != io.EOF {
-						logger.Warn("Reading from dest", zap.Error(err))
-						hasError = true
+					if isTimeout(err) && !sess.isTerminated() {
+						logger.Warn("Upstream read timeout. Close session", zap.Duration("read_timeout", readTimeout))
+						sess.terminate("upstream_read_timeout", websocket.CloseGoingAway, "upstream read timeout")
 					}
-					if disconnectAt == "" {
-						disconnectAt = "upstream_read"
+					if !sess.isTerminated() && err != io.EOF {
+						logger.Warn("Reading from dest", zap.Error(err))
+						sess.fail()
 					}
+					sess.disconnect("upstream_read")
 					return
 				}
 
 				if h.dumpTCP > 1 {
 					ds.Write(b)
 				}
+				conn.SetWriteDeadline(writeDeadline(writeTimeout))
 				if err := conn.WriteMessage(websocket.BinaryMessage, b[:n]); err != nil {
-					if !goClose {
-						logger.Warn("WriteMessage", zap.Error(err))
-						hasError = true
+					if isTimeout(err) && !sess.isTerminated() {
+						logger.Warn("Client write timeout. Close session", zap.Duration("write_timeout", writeTimeout))
+						sess.terminate("client_write_timeout", websocket.CloseGoingAway, "client write timeout")
 					}
-					if disconnectAt == "" {
-						disconnectAt = "client_write"
+					if !sess.isTerminated() {
+						logger.Warn("WriteMessage", zap.Error(err))
+						sess.fail()
 					}
+					sess.disconnect("client_write")
 					return
 				}
 				writeLen += int64(n)
+				sess.touch()
 			}
 		}()
 
 		<-doneCh
-		goClose = true
+		sess.finish()
 		s.Close()
 		conn.Close()
 		<-doneCh
@@ -1,19 +1,39 @@
 package handler
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"golang.org/x/net/websocket"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	gws "github.com/gorilla/websocket"
+	"github.com/kazeburo/wsgate-server/internal/apikey"
+	"github.com/kazeburo/wsgate-server/internal/auth"
 	"github.com/kazeburo/wsgate-server/internal/mapping"
 	"github.com/kazeburo/wsgate-server/internal/publickey"
 	"github.com/stretchr/testify/assert"
@@ -44,6 +64,11 @@ func TestHello(t *testing.T) {
 	assert.Equal(t, "OK\n", rec.Body.String())
 }
 
+func TestWriteDeadline(t *testing.T) {
+	assert.True(t, writeDeadline(0).IsZero())
+	assert.WithinDuration(t, time.Now().Add(time.Second), writeDeadline(time.Second), 100*time.Millisecond)
+}
+
 func createClient(wsAddr string, disableKeepalive bool) *http.Client {
 	client := &http.Client{
 		Transport: &http.Transport{
@@ -137,3 +162,1284 @@ func TestWebSocket(t *testing.T) {
 	}
 	assert.Equal(t, uint64(4), proxyHandler.GetSq())
 }
+
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func newMapping(t *testing.T, body string) *mapping.Mapping {
+	t.Helper()
+	mapFile := filepath.Join(t.TempDir(), "map.yaml")
+	assert.NoError(t, os.WriteFile(mapFile, []byte(body), 0o644))
+	mp, err := mapping.New(mapFile, zap.NewNop())
+	assert.NoError(t, err)
+	return mp
+}
+
+func TestDialFailover(t *testing.T) {
+	logger := zap.NewNop()
+
+	dummyHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello from dummy server"))
+	})
+	ts := httptest.NewServer(dummyHandler)
+	defer ts.Close()
+
+	mp := newMapping(t, fmt.Sprintf(`
+destinations:
+  - name: dummy
+    upstreams: [%s, %s]
+  - name: dead
+    upstreams: [%s, %s]
+`, closedAddr(t), ts.Listener.Addr().String(), closedAddr(t), closedAddr(t)))
+	pk, _ := publickey.New("", time.Minute, logger)
+
+	proxyHandler, err := New(
+		10*time.Second,
+		time.Second,
+		10*time.Second,
+		false,
+		mp,
+		pk,
+		0,
+		logger,
+		WithDialFailover(2, 5*time.Second),
+	)
+	assert.NoError(t, err)
+
+	wg := &sync.WaitGroup{}
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(wg))
+	ws := httptest.NewServer(m)
+	defer ws.Close()
+
+	// round robin starts from the dead member every other session
+	for i := 0; i < 4; i++ {
+		client := createClient(ws.Listener.Addr().String(), true)
+		req, _ := http.NewRequest(http.MethodGet, "http://example/test", nil)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "Hello from dummy server", string(body))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy/dead", nil)
+	req = mux.SetURLVars(req, map[string]string{"dest": "dead"})
+	rec := httptest.NewRecorder()
+	proxyHandler.Proxy(wg)(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestUnixSocketUpstream(t *testing.T) {
+	logger := zap.NewNop()
+
+	sock := filepath.Join(t.TempDir(), "dummy.sock")
+	l, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello from unix socket"))
+	}))
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	mp, _ := mapping.New("", logger)
+	mp.Set("dummy", "unix:"+sock)
+	pk, _ := publickey.New("", time.Minute, logger)
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, pk, 0, logger)
+	assert.NoError(t, err)
+
+	wg := &sync.WaitGroup{}
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(wg))
+	ws := httptest.NewServer(m)
+	defer ws.Close()
+
+	client := createClient(ws.Listener.Addr().String(), true)
+	req, _ := http.NewRequest(http.MethodGet, "http://example/test", nil)
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "Hello from unix socket", string(body))
+}
+
+func TestTLSUpstream(t *testing.T) {
+	logger := zap.NewNop()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello from TLS server"))
+	}))
+	defer ts.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ts.Certificate().Raw,
+	}), 0o644))
+
+	tests := []struct {
+		name string
+		tls  string
+		body string
+	}{
+		{"ca", fmt.Sprintf("{enabled: true, ca_file: %s, server_name: example.com}", caFile), "Hello from TLS server"},
+		{"insecure", "{enabled: true, insecure_skip_verify: true}", "Hello from TLS server"},
+		{"untrusted", "{enabled: true}", ""},
+		{"wrong name", fmt.Sprintf("{enabled: true, ca_file: %s, server_name: example.net}", caFile), ""},
+	}
+	// dial timeout 0 means no limit
+	for _, dialTimeout := range []time.Duration{time.Second, 0} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/%s", tt.name, dialTimeout), func(t *testing.T) {
+				mp := newMapping(t, fmt.Sprintf(`
+destinations:
+  - name: dummy
+    upstreams: [%s]
+    tls: %s
+`, ts.Listener.Addr().String(), tt.tls))
+				pk, _ := publickey.New("", time.Minute, logger)
+				proxyHandler, err := New(10*time.Second, dialTimeout, 10*time.Second, false, mp, pk, 0, logger)
+				assert.NoError(t, err)
+
+				wg := &sync.WaitGroup{}
+				m := mux.NewRouter()
+				m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(wg))
+				ws := httptest.NewServer(m)
+				defer ws.Close()
+
+				client := createClient(ws.Listener.Addr().String(), true)
+				req, _ := http.NewRequest(http.MethodGet, "http://example/test", nil)
+				resp, err := client.Do(req)
+				if tt.body == "" {
+					assert.Error(t, err)
+					return
+				}
+				assert.NoError(t, err)
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				assert.Equal(t, tt.body, string(body))
+			})
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	h, err := New(10*time.Second, 10*time.Second, 10*time.Second, false, nil, nil, 0, zap.NewNop(),
+		WithTrustedProxies([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1:1234"},
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1:1234"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1:0"},
+		{"10.0.0.1:1234", "203.0.113.1, 198.51.100.1, 10.0.0.2", "198.51.100.1:0"},
+		{"10.0.0.1:1234", "", "10.0.0.1:1234"},
+		{"10.0.0.1:1234", "garbage", "10.0.0.1:1234"},
+		{"[2001:db8::1]:1234", "", "[2001:db8::1]:1234"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/proxy/dummy", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		assert.Equal(t, tt.want, h.clientAddr(req).String(), tt)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	logger := zap.NewNop()
+
+	// reply the PROXY protocol header as HTTP response body
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				header, _ := br.ReadString('\n')
+				http.ReadRequest(br)
+				fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(header), header)
+			}(c)
+		}
+	}()
+
+	mp := newMapping(t, fmt.Sprintf(`
+destinations:
+  - name: dummy
+    upstreams: [%s]
+    proxy_protocol: 1
+`, l.Addr().String()))
+	pk, _ := publickey.New("", time.Minute, logger)
+	// dial timeout 0 means no limit
+	for _, dialTimeout := range []time.Duration{time.Second, 0} {
+		proxyHandler, err := New(10*time.Second, dialTimeout, 10*time.Second, false, mp, pk, 0, logger)
+		assert.NoError(t, err)
+
+		wg := &sync.WaitGroup{}
+		m := mux.NewRouter()
+		m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(wg))
+		ws := httptest.NewServer(m)
+		defer ws.Close()
+
+		client := createClient(ws.Listener.Addr().String(), true)
+		req, _ := http.NewRequest(http.MethodGet, "http://example/test", nil)
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err, dialTimeout) {
+			continue
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		_, wsPort, _ := net.SplitHostPort(ws.Listener.Addr().String())
+		assert.Regexp(t, `^PROXY TCP4 127\.0\.0\.1 127\.0\.0\.1 \d+ `+wsPort+"\r\n$", string(body))
+	}
+}
+
+// newRSAKey key pair to sign tokens. Returns the path of the public key in PEM
+func newRSAKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	assert.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "pub.pem")
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0o644))
+	return privateKey, keyFile
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	now := time.Now()
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Minute).Unix()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	assert.NoError(t, err)
+	return token
+}
+
+func TestAuthorization(t *testing.T) {
+	logger := zap.NewNop()
+
+	privateKey, keyFile := newRSAKey(t)
+	pk, err := publickey.New(keyFile, time.Minute, logger)
+	assert.NoError(t, err)
+
+	mp := newMapping(t, fmt.Sprintf(`
+destinations:
+  - name: db
+    upstreams: [%s]
+    authorization:
+      - name: dba
+        groups: [dba]
+`, closedAddr(t)))
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, pk, 0, logger)
+	assert.NoError(t, err)
+
+	for _, tt := range []struct {
+		groups []string
+		code   int
+	}{
+		{[]string{"dev"}, http.StatusForbidden},
+		// authorized, then fails to connect
+		{[]string{"dba"}, http.StatusInternalServerError},
+	} {
+		token := signToken(t, privateKey, jwt.MapClaims{"sub": "alice", "groups": tt.groups})
+
+		req := httptest.NewRequest(http.MethodGet, "/proxy/db", nil)
+		req = mux.SetURLVars(req, map[string]string{"dest": "db"})
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		proxyHandler.Proxy(&sync.WaitGroup{})(rec, req)
+		assert.Equal(t, tt.code, rec.Code, tt.groups)
+	}
+}
+
+func TestIAP(t *testing.T) {
+	logger := zap.NewNop()
+	audience := "/projects/1234/global/backendServices/5678"
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	enc := base64.RawURLEncoding.EncodeToString
+	b, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "EC", "kid": "iap", "crv": "P-256", "alg": "ES256",
+				"x": enc(key.X.FillBytes(make([]byte, 32))), "y": enc(key.Y.FillBytes(make([]byte, 32)))},
+		},
+	})
+	assert.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "iap.json")
+	assert.NoError(t, os.WriteFile(jwksFile, b, 0o644))
+
+	iap, err := publickey.NewIAP([]string{audience}, time.Minute, logger,
+		publickey.WithJWKS(jwksFile, time.Hour, time.Minute))
+	assert.NoError(t, err)
+	pk, err := publickey.New("", time.Minute, logger)
+	assert.NoError(t, err)
+
+	mp := newMapping(t, fmt.Sprintf(`
+destinations:
+  - name: db
+    upstreams: [%s]
+    allowed_users:
+      - accounts.google.com:alice@example.com
+`, closedAddr(t)))
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, pk, 0, logger, WithIAP(iap))
+	assert.NoError(t, err)
+
+	assertion := func(email string) string {
+		now := time.Now()
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"iss":   publickey.IAPIssuer,
+			"aud":   audience,
+			"sub":   "accounts.google.com:1234567890",
+			"email": email,
+			"iat":   now.Unix(),
+			"exp":   now.Add(10 * time.Minute).Unix(),
+		})
+		token.Header["kid"] = "iap"
+		s, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return s
+	}
+
+	for _, tt := range []struct {
+		name   string
+		header map[string]string
+		code   int
+	}{
+		{
+			"spoofed header",
+			map[string]string{"X-Goog-Authenticated-User-Email": "accounts.google.com:alice@example.com"},
+			http.StatusUnauthorized,
+		},
+		{
+			"not allowed",
+			map[string]string{publickey.IAPHeader: assertion("bob@example.com")},
+			http.StatusForbidden,
+		},
+		{
+			// allowed, then fails to connect
+			"verified",
+			map[string]string{
+				publickey.IAPHeader:               assertion("alice@example.com"),
+				"X-Goog-Authenticated-User-Email": "accounts.google.com:bob@example.com",
+			},
+			http.StatusInternalServerError,
+		},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/proxy/db", nil)
+		req = mux.SetURLVars(req, map[string]string{"dest": "db"})
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		proxyHandler.Proxy(&sync.WaitGroup{})(rec, req)
+		assert.Equal(t, tt.code, rec.Code, tt.name)
+	}
+}
+
+func TestTokenTransport(t *testing.T) {
+	logger := zap.NewNop()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	mp := newMapping(t, fmt.Sprintf("destinations:\n  - name: dummy\n    upstreams: [%s]\n", ts.Listener.Addr().String()))
+
+	privateKey, keyFile := newRSAKey(t)
+	pk, err := publickey.New(keyFile, time.Minute, logger)
+	assert.NoError(t, err)
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, pk, 0, logger,
+		WithTokenTransport("access_token", true))
+	assert.NoError(t, err)
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+	ws := httptest.NewServer(m)
+	defer ws.Close()
+
+	token := signToken(t, privateKey, jwt.MapClaims{"sub": "alice"})
+	tests := []struct {
+		name        string
+		query       string
+		protocols   []string
+		subprotocol string
+		err         bool
+	}{
+		{"query", "?access_token=" + token, nil, "", false},
+		{"other query", "?token=" + token, nil, "", true},
+		{"subprotocol", "", []string{"bearer." + token}, "bearer." + token, false},
+		{"subprotocol with others", "", []string{"binary", "bearer." + token}, "binary", false},
+		{"invalid subprotocol", "", []string{"bearer.invalid"}, "", true},
+		{"no token", "", []string{"binary"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := websocket.NewConfig("ws://"+ws.Listener.Addr().String()+"/proxy/dummy"+tt.query, "http://localhost")
+			assert.NoError(t, err)
+			config.Protocol = tt.protocols
+			conn, err := websocket.DialConfig(config)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			defer conn.Close()
+			if tt.subprotocol != "" {
+				assert.Equal(t, []string{tt.subprotocol}, conn.Config().Protocol)
+			}
+		})
+	}
+
+	assert.Equal(t, "token is invalid: "+redacted, redact("token is invalid: "+token, "Bearer "+token))
+	assert.Equal(t, "no tokenString", redact("no tokenString", ""))
+}
+
+// echoAddr address of a TCP server which echoes back
+func echoAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				io.Copy(c, c)
+			}(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTokenExpiry(t *testing.T) {
+	logger := zap.NewNop()
+	mp := newMapping(t, fmt.Sprintf(`
+destinations:
+  - name: echo
+    upstreams: [%s]
+    authorization:
+      - name: dba
+        groups: [dba]
+`, echoAddr(t)))
+
+	privateKey, keyFile := newRSAKey(t)
+	pk, err := publickey.New(keyFile, time.Minute, logger)
+	assert.NoError(t, err)
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, pk, 0, logger,
+		WithTokenExpiry(true, 0, true))
+	assert.NoError(t, err)
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+	ws := httptest.NewServer(m)
+	defer ws.Close()
+	url := "ws://" + ws.Listener.Addr().String() + "/proxy/echo"
+
+	expiringToken := func(sub string, ttl time.Duration, groups ...string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"sub":    sub,
+			"groups": groups,
+			"iat":    time.Now().Unix(),
+			"exp":    time.Now().Add(ttl).Unix(),
+		}).SignedString(privateKey)
+		assert.NoError(t, err)
+		return token
+	}
+	dial := func() *gws.Conn {
+		conn, _, err := gws.DefaultDialer.Dial(url, http.Header{
+			"Authorization": {"Bearer " + expiringToken("alice", 2*time.Second, "dba")},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("ping")))
+		_, b, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(b))
+		return conn
+	}
+	readClose := func(conn *gws.Conn) *gws.CloseError {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				ce, _ := err.(*gws.CloseError)
+				return ce
+			}
+		}
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		conn := dial()
+		defer conn.Close()
+		ce := readClose(conn)
+		if assert.NotNil(t, ce) {
+			assert.Equal(t, gws.ClosePolicyViolation, ce.Code)
+			assert.Equal(t, "token expired", ce.Text)
+		}
+	})
+
+	t.Run("reauth", func(t *testing.T) {
+		conn := dial()
+		defer conn.Close()
+		assert.NoError(t, conn.WriteMessage(gws.TextMessage, []byte(expiringToken("alice", time.Hour, "dba"))))
+		// still open after the first token expired
+		time.Sleep(3 * time.Second)
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("pong")))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, b, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, "pong", string(b))
+	})
+
+	t.Run("reauth as another subject", func(t *testing.T) {
+		conn := dial()
+		defer conn.Close()
+		assert.NoError(t, conn.WriteMessage(gws.TextMessage, []byte(expiringToken("bob", time.Hour, "dba"))))
+		ce := readClose(conn)
+		if assert.NotNil(t, ce) {
+			assert.Equal(t, "re-authentication failed", ce.Text)
+		}
+	})
+
+	t.Run("reauth without the group", func(t *testing.T) {
+		conn := dial()
+		defer conn.Close()
+		assert.NoError(t, conn.WriteMessage(gws.TextMessage, []byte(expiringToken("alice", time.Hour, "dev"))))
+		ce := readClose(conn)
+		if assert.NotNil(t, ce) {
+			assert.Equal(t, gws.ClosePolicyViolation, ce.Code)
+			assert.Equal(t, "re-authentication failed", ce.Text)
+		}
+	})
+}
+
+func TestTokenExpiryLeeway(t *testing.T) {
+	logger := zap.NewNop()
+	mp := newMapping(t, fmt.Sprintf("destinations:\n  - name: echo\n    upstreams: [%s]\n", echoAddr(t)))
+	privateKey, keyFile := newRSAKey(t)
+	pk, err := publickey.New(keyFile, time.Minute, logger, publickey.WithLeeway(3*time.Second))
+	assert.NoError(t, err)
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, pk, 0, logger,
+		WithTokenExpiry(true, 0, false))
+	assert.NoError(t, err)
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+	ws := httptest.NewServer(m)
+	defer ws.Close()
+
+	// expired, but accepted within the leeway
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "alice",
+		"iat": time.Now().Add(-time.Minute).Unix(),
+		"exp": time.Now().Add(-time.Second).Unix(),
+	}).SignedString(privateKey)
+	assert.NoError(t, err)
+	conn, _, err := gws.DefaultDialer.Dial("ws://"+ws.Listener.Addr().String()+"/proxy/echo", http.Header{
+		"Authorization": {"Bearer " + token},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// not closed until the leeway ends
+	time.Sleep(500 * time.Millisecond)
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("ping")))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, b, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+
+	_, _, err = conn.ReadMessage()
+	ce, ok := err.(*gws.CloseError)
+	if assert.True(t, ok, err) {
+		assert.Equal(t, "token expired", ce.Text)
+	}
+}
+
+func TestCloseRevoked(t *testing.T) {
+	logger := zap.NewNop()
+	mp := newMapping(t, fmt.Sprintf("destinations:\n  - name: echo\n    upstreams: [%s]\n", echoAddr(t)))
+
+	revocationFile := filepath.Join(t.TempDir(), "revoked.yaml")
+	assert.NoError(t, os.WriteFile(revocationFile, []byte("subjects: []\n"), 0o644))
+	rv, err := publickey.NewRevocation(revocationFile, logger)
+	assert.NoError(t, err)
+	privateKey, keyFile := newRSAKey(t)
+	pk, err := publickey.New(keyFile, time.Minute, logger, publickey.WithRevocation(rv))
+	assert.NoError(t, err)
+	// an API key named as a revoked subject
+	sum := sha256.Sum256([]byte("alice-secret"))
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	assert.NoError(t, os.WriteFile(keysFile, []byte(fmt.Sprintf("keys:\n  - {name: alice, hash: 'sha256:%x', destinations: ['*']}\n", sum)), 0o644))
+	keys, err := apikey.New(keysFile, logger)
+	assert.NoError(t, err)
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, pk, 0, logger, WithAPIKeys(keys))
+	assert.NoError(t, err)
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+	ws := httptest.NewServer(m)
+	defer ws.Close()
+
+	dialWith := func(authorization string) *gws.Conn {
+		conn, _, err := gws.DefaultDialer.Dial("ws://"+ws.Listener.Addr().String()+"/proxy/echo", http.Header{
+			"Authorization": {authorization},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("ping")))
+		_, _, err = conn.ReadMessage()
+		assert.NoError(t, err)
+		return conn
+	}
+	dial := func(sub string) *gws.Conn {
+		return dialWith("Bearer " + signToken(t, privateKey, jwt.MapClaims{"sub": sub}))
+	}
+	alice := dial("alice")
+	defer alice.Close()
+	bob := dial("bob")
+	defer bob.Close()
+	aliceKey := dialWith("ApiKey alice-secret")
+	defer aliceKey.Close()
+
+	assert.NoError(t, os.WriteFile(revocationFile, []byte("subjects: [alice]\n"), 0o644))
+	changed, err := rv.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	proxyHandler.CloseRevoked()
+
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = alice.ReadMessage()
+	if assert.IsType(t, &gws.CloseError{}, err) {
+		assert.Equal(t, "token revoked", err.(*gws.CloseError).Text)
+	}
+
+	for _, conn := range []*gws.Conn{bob, aliceKey} {
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("pong")))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, b, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, "pong", string(b))
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	logger := zap.NewNop()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+	issue := func(cn string, ou []string, emails []string) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber:   big.NewInt(time.Now().UnixNano()),
+			Subject:        pkix.Name{CommonName: cn, OrganizationalUnit: ou},
+			EmailAddresses: emails,
+			NotBefore:      time.Now().Add(-time.Hour),
+			NotAfter:       time.Now().Add(time.Hour),
+			KeyUsage:       x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, &key.PublicKey, caKey)
+		assert.NoError(t, err)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	mp := newMapping(t, fmt.Sprintf(`
+destinations:
+  - name: echo
+    upstreams: [%s]
+    authorization:
+      - groups: [ci]
+`, echoAddr(t)))
+	privateKey, keyFile := newRSAKey(t)
+	pk, err := publickey.New(keyFile, time.Minute, logger)
+	assert.NoError(t, err)
+
+	_, err = New(10*time.Second, time.Second, 10*time.Second, false, mp, pk, 0, logger, WithClientCert("serial"))
+	assert.ErrorContains(t, err, "unknown client certificate identity")
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, pk, 0, logger,
+		WithClientCert(ClientIdentityEmail))
+	assert.NoError(t, err)
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+	ws := httptest.NewUnstartedServer(m)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ws.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	ws.StartTLS()
+	defer ws.Close()
+
+	tests := []struct {
+		name   string
+		certs  []tls.Certificate
+		header http.Header
+		code   int
+	}{
+		{"ci", []tls.Certificate{issue("builder", []string{"ci"}, []string{"builder@example.com"})}, nil, http.StatusSwitchingProtocols},
+		{"not in group", []tls.Certificate{issue("laptop", []string{"dev"}, []string{"laptop@example.com"})}, nil, http.StatusForbidden},
+		{"no email", []tls.Certificate{issue("builder", []string{"ci"}, nil)}, nil, http.StatusUnauthorized},
+		// falls back to JWT
+		{"no certificate", nil, http.Header{"Authorization": {"Bearer " + signToken(t, privateKey, jwt.MapClaims{"sub": "alice", "groups": []string{"ci"}})}}, http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootCAs := x509.NewCertPool()
+			rootCAs.AddCert(ws.Certificate())
+			dialer := &gws.Dialer{TLSClientConfig: &tls.Config{RootCAs: rootCAs, Certificates: tt.certs}}
+			conn, resp, err := dialer.Dial("wss://"+ws.Listener.Addr().String()+"/proxy/echo", tt.header)
+			if assert.NotNil(t, resp) {
+				assert.Equal(t, tt.code, resp.StatusCode)
+			}
+			if err == nil {
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	logger := zap.NewNop()
+	mp := newMapping(t, fmt.Sprintf(`
+destinations:
+  - name: echo
+    upstreams: [%s]
+  - name: other
+    upstreams: [%s]
+`, echoAddr(t), echoAddr(t)))
+
+	sum := sha256.Sum256([]byte("ci-secret"))
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	assert.NoError(t, os.WriteFile(keysFile, []byte(fmt.Sprintf(`
+keys:
+  - name: ci
+    hash: sha256:%x
+    destinations: [echo]
+`, sum)), 0o644))
+	keys, err := apikey.New(keysFile, logger)
+	assert.NoError(t, err)
+	privateKey, keyFile := newRSAKey(t)
+	pk, err := publickey.New(keyFile, time.Minute, logger)
+	assert.NoError(t, err)
+
+	_, err = New(10*time.Second, time.Second, 10*time.Second, false, mp, pk, 0, logger, WithAuthOrder([]string{"jwt", "password"}))
+	assert.ErrorContains(t, err, "unknown authentication method: password")
+
+	for _, order := range [][]string{DefaultAuthOrder, {AuthJWT, AuthAPIKey}} {
+		proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, pk, 0, logger,
+			WithAPIKeys(keys), WithAuthOrder(order))
+		assert.NoError(t, err)
+		m := mux.NewRouter()
+		m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+		ws := httptest.NewServer(m)
+
+		tests := []struct {
+			name          string
+			dest          string
+			authorization string
+			code          int
+		}{
+			{"api key", "echo", "ApiKey ci-secret", http.StatusSwitchingProtocols},
+			{"out of scope", "other", "ApiKey ci-secret", http.StatusForbidden},
+			{"wrong key", "echo", "ApiKey wrong", http.StatusUnauthorized},
+			{"jwt", "other", "Bearer " + signToken(t, privateKey, jwt.MapClaims{"sub": "alice"}), http.StatusSwitchingProtocols},
+			{"no credentials", "echo", "", http.StatusUnauthorized},
+		}
+		for _, tt := range tests {
+			header := http.Header{}
+			if tt.authorization != "" {
+				header.Set("Authorization", tt.authorization)
+			}
+			conn, resp, err := gws.DefaultDialer.Dial("ws://"+ws.Listener.Addr().String()+"/proxy/"+tt.dest, header)
+			if assert.NotNil(t, resp, tt.name) {
+				assert.Equal(t, tt.code, resp.StatusCode, "%s %v", tt.name, order)
+			}
+			if err == nil {
+				conn.Close()
+			}
+		}
+		ws.Close()
+	}
+}
+
+func TestHeaderFallback(t *testing.T) {
+	logger := zap.NewNop()
+	mp := newMapping(t, fmt.Sprintf(`
+destinations:
+  - name: secret
+    upstreams: [%s]
+`, echoAddr(t)))
+	sum := sha256.Sum256([]byte("ci-secret"))
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	assert.NoError(t, os.WriteFile(keysFile, []byte(fmt.Sprintf(`
+keys:
+  - name: ci
+    hash: sha256:%x
+    destinations: [other]
+`, sum)), 0o644))
+	keys, err := apikey.New(keysFile, logger)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		opts []Option
+		code int
+	}{
+		{"no method", nil, http.StatusSwitchingProtocols},
+		{"api keys", []Option{WithAPIKeys(keys)}, http.StatusUnauthorized},
+		{"client certificates", []Option{WithClientCert(ClientIdentityCN)}, http.StatusUnauthorized},
+		{"explicit", []Option{WithAPIKeys(keys), WithAuthOrder([]string{AuthAPIKey, AuthHeader})}, http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, nil, 0, logger, tt.opts...)
+			assert.NoError(t, err)
+			m := mux.NewRouter()
+			m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+			ws := httptest.NewServer(m)
+			defer ws.Close()
+
+			conn, resp, err := gws.DefaultDialer.Dial("ws://"+ws.Listener.Addr().String()+"/proxy/secret", http.Header{
+				"X-Goog-Authenticated-User-Email": {"accounts.google.com:mallory@example.com"},
+			})
+			if assert.NotNil(t, resp) {
+				assert.Equal(t, tt.code, resp.StatusCode)
+			}
+			if err == nil {
+				conn.Close()
+			}
+		})
+	}
+}
+
+// teamAuthenticator stands in for a custom authenticator
+type teamAuthenticator struct {
+	revoked string
+}
+
+func (a *teamAuthenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	user := r.Header.Get("X-Team-User")
+	if user == "" {
+		return nil, auth.ErrNoCredentials
+	}
+	return &auth.Identity{
+		Method:  "team",
+		Subject: user,
+		Email:   user + "@example.com",
+		Groups:  r.Header.Values("X-Team-Group"),
+	}, nil
+}
+
+func (a *teamAuthenticator) Revoked(id *auth.Identity) error {
+	if id.Subject == a.revoked {
+		return fmt.Errorf("%s is revoked", id.Subject)
+	}
+	return nil
+}
+
+func TestAuthenticator(t *testing.T) {
+	logger := zap.NewNop()
+	mp := newMapping(t, fmt.Sprintf(`
+destinations:
+  - name: echo
+    upstreams: [%s]
+    authorization:
+      - groups: [dba]
+        email_domains: [example.com]
+`, echoAddr(t)))
+	a := &teamAuthenticator{}
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, nil, 0, logger,
+		WithAuthenticator(auth.Chain{a}))
+	assert.NoError(t, err)
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+	ws := httptest.NewServer(m)
+	defer ws.Close()
+	url := "ws://" + ws.Listener.Addr().String() + "/proxy/echo"
+
+	_, resp, err := gws.DefaultDialer.Dial(url, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	_, resp, err = gws.DefaultDialer.Dial(url, http.Header{"X-Team-User": {"alice"}, "X-Team-Group": {"dev"}})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	alice, _, err := gws.DefaultDialer.Dial(url, http.Header{"X-Team-User": {"alice"}, "X-Team-Group": {"dev", "dba"}})
+	assert.NoError(t, err)
+	defer alice.Close()
+
+	a.revoked = "alice"
+	proxyHandler.CloseRevoked()
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = alice.ReadMessage()
+	if assert.IsType(t, &gws.CloseError{}, err) {
+		assert.Equal(t, "token revoked", err.(*gws.CloseError).Text)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	logger := zap.NewNop()
+	mp := newMapping(t, fmt.Sprintf("destinations:\n  - name: echo\n    upstreams: [%s]\n", echoAddr(t)))
+
+	_, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, nil, 0, logger,
+		WithKeepalive(time.Second, time.Second))
+	assert.Error(t, err)
+
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, nil, 0, logger,
+		WithKeepalive(200*time.Millisecond, time.Second))
+	assert.NoError(t, err)
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+	ws := httptest.NewServer(m)
+	defer ws.Close()
+
+	dial := func() *gws.Conn {
+		conn, _, err := gws.DefaultDialer.Dial("ws://"+ws.Listener.Addr().String()+"/proxy/echo", nil)
+		assert.NoError(t, err)
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("ping")))
+		_, b, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(b))
+		return conn
+	}
+
+	t.Run("alive", func(t *testing.T) {
+		conn := dial()
+		defer conn.Close()
+		pings := make(chan struct{}, 100)
+		conn.SetPingHandler(func(data string) error {
+			pings <- struct{}{}
+			return conn.WriteControl(gws.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		msgs := make(chan []byte)
+		go func() {
+			for {
+				_, b, err := conn.ReadMessage()
+				if err != nil {
+					close(msgs)
+					return
+				}
+				msgs <- b
+			}
+		}()
+		// answering pings keeps the session open longer than pong wait
+		time.Sleep(2 * time.Second)
+		assert.NotEmpty(t, pings)
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("pong")))
+		select {
+		case b := <-msgs:
+			assert.Equal(t, "pong", string(b))
+		case <-time.After(5 * time.Second):
+			t.Fatal("no echo")
+		}
+	})
+
+	t.Run("dead", func(t *testing.T) {
+		conn := dial()
+		defer conn.Close()
+		// a client not answering pings
+		conn.SetPingHandler(func(string) error { return nil })
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				if assert.IsType(t, &gws.CloseError{}, err) {
+					assert.Equal(t, gws.CloseGoingAway, err.(*gws.CloseError).Code)
+					assert.Equal(t, "ping timeout", err.(*gws.CloseError).Text)
+				}
+				return
+			}
+		}
+	})
+}
+
+func TestSessionLimits(t *testing.T) {
+	logger := zap.NewNop()
+	mp := newMapping(t, fmt.Sprintf(`destinations:
+  - name: idle
+    upstreams: [%[1]s]
+    idle_timeout: 500ms
+  - name: lifetime
+    upstreams: [%[1]s]
+    max_lifetime: 1s
+  - name: default
+    upstreams: [%[1]s]
+  - name: tiny
+    upstreams: [%[1]s]
+    idle_timeout: 1ns
+`, echoAddr(t)))
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, nil, 0, logger,
+		WithSessionLimits(time.Hour, time.Hour))
+	assert.NoError(t, err)
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+	ws := httptest.NewServer(m)
+	defer ws.Close()
+
+	dial := func(dest string) *gws.Conn {
+		conn, _, err := gws.DefaultDialer.Dial("ws://"+ws.Listener.Addr().String()+"/proxy/"+dest, nil)
+		assert.NoError(t, err)
+		return conn
+	}
+	echo := func(conn *gws.Conn) error {
+		if err := conn.WriteMessage(gws.BinaryMessage, []byte("ping")); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		return err
+	}
+	// send a message every 200ms until the session is closed
+	keepBusy := func(conn *gws.Conn) (*gws.CloseError, time.Duration) {
+		start := time.Now()
+		for {
+			if err := echo(conn); err != nil {
+				ce, _ := err.(*gws.CloseError)
+				return ce, time.Since(start)
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		conn := dial("idle")
+		defer conn.Close()
+		// traffic keeps the session open longer than idle_timeout
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, echo(conn))
+			time.Sleep(200 * time.Millisecond)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if assert.IsType(t, &gws.CloseError{}, err) {
+			assert.Equal(t, gws.CloseGoingAway, err.(*gws.CloseError).Code)
+			assert.Equal(t, "idle timeout (500ms)", err.(*gws.CloseError).Text)
+		}
+	})
+
+	t.Run("max lifetime", func(t *testing.T) {
+		conn := dial("lifetime")
+		defer conn.Close()
+		ce, elapsed := keepBusy(conn)
+		if assert.NotNil(t, ce) {
+			assert.Equal(t, "max session lifetime (1s) exceeded", ce.Text)
+		}
+		assert.Less(t, elapsed, 3*time.Second)
+	})
+
+	t.Run("tiny idle timeout", func(t *testing.T) {
+		conn := dial("tiny")
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if assert.IsType(t, &gws.CloseError{}, err) {
+			assert.Equal(t, "idle timeout (1ns)", err.(*gws.CloseError).Text)
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		conn := dial("default")
+		defer conn.Close()
+		time.Sleep(time.Second)
+		assert.NoError(t, echo(conn))
+	})
+}
+
+// stalledAddr upstream which accepts connections and calls serve with them
+func stalledAddr(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				serve(c)
+			}(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestStalledPeer(t *testing.T) {
+	logger := zap.NewNop()
+	// never reads
+	stalled := stalledAddr(t, func(c net.Conn) {
+		time.Sleep(time.Minute)
+	})
+	// writes until the connection is closed
+	upstreamClosed := make(chan struct{}, 1)
+	flood := stalledAddr(t, func(c net.Conn) {
+		b := make([]byte, BufferSize)
+		for {
+			if _, err := c.Write(b); err != nil {
+				upstreamClosed <- struct{}{}
+				return
+			}
+		}
+	})
+	mp := newMapping(t, fmt.Sprintf(`destinations:
+  - name: stalled
+    upstreams: [%s]
+  - name: flood
+    upstreams: [%s]
+  - name: quiet
+    upstreams: [%s]
+    read_timeout: 500ms
+`, stalled, flood, stalled))
+	proxyHandler, err := New(10*time.Second, time.Second, 500*time.Millisecond, false, mp, nil, 0, logger)
+	assert.NoError(t, err)
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+	ws := httptest.NewServer(m)
+	defer ws.Close()
+
+	dial := func(dest string) *gws.Conn {
+		conn, _, err := gws.DefaultDialer.Dial("ws://"+ws.Listener.Addr().String()+"/proxy/"+dest, nil)
+		assert.NoError(t, err)
+		return conn
+	}
+	readClose := func(conn *gws.Conn) *gws.CloseError {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				ce, _ := err.(*gws.CloseError)
+				return ce
+			}
+		}
+	}
+
+	t.Run("upstream not reading", func(t *testing.T) {
+		conn := dial("stalled")
+		defer conn.Close()
+		go func() {
+			b := make([]byte, BufferSize)
+			for {
+				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if err := conn.WriteMessage(gws.BinaryMessage, b); err != nil {
+					return
+				}
+			}
+		}()
+		ce := readClose(conn)
+		if assert.NotNil(t, ce) {
+			assert.Equal(t, gws.CloseGoingAway, ce.Code)
+			assert.Equal(t, "upstream write timeout", ce.Text)
+		}
+	})
+
+	t.Run("client not reading", func(t *testing.T) {
+		conn := dial("flood")
+		defer conn.Close()
+		select {
+		case <-upstreamClosed:
+		case <-time.After(10 * time.Second):
+			t.Fatal("upstream is not closed")
+		}
+	})
+
+	t.Run("upstream read timeout", func(t *testing.T) {
+		conn := dial("quiet")
+		defer conn.Close()
+		// the client is not quiet
+		go func() {
+			for {
+				if err := conn.WriteMessage(gws.BinaryMessage, []byte("ping")); err != nil {
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+		ce := readClose(conn)
+		if assert.NotNil(t, ce) {
+			assert.Equal(t, "upstream read timeout", ce.Text)
+		}
+	})
+}
+
+func TestClientReadTimeout(t *testing.T) {
+	logger := zap.NewNop()
+	// writes every 100ms
+	ticking := stalledAddr(t, func(c net.Conn) {
+		for {
+			if _, err := c.Write([]byte("tick")); err != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+	mp := newMapping(t, fmt.Sprintf("destinations:\n  - name: ticking\n    upstreams: [%s]\n", ticking))
+	proxyHandler, err := New(10*time.Second, time.Second, 10*time.Second, false, mp, nil, 0, logger,
+		WithReadTimeout(time.Second))
+	assert.NoError(t, err)
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{dest}", proxyHandler.Proxy(&sync.WaitGroup{}))
+	ws := httptest.NewServer(m)
+	defer ws.Close()
+
+	conn, _, err := gws.DefaultDialer.Dial("ws://"+ws.Listener.Addr().String()+"/proxy/ticking", nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	// sending keeps the session open longer than the read timeout
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("ping")))
+		time.Sleep(500 * time.Millisecond)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	if assert.IsType(t, &gws.CloseError{}, err) {
+		assert.Equal(t, gws.CloseGoingAway, err.(*gws.CloseError).Code)
+		assert.Equal(t, "client read timeout", err.(*gws.CloseError).Text)
+	}
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
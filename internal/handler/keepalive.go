@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// WithKeepalive send WebSocket pings to clients every pingInterval, and close sessions
+// when neither a pong nor a message arrives within pongWait. pingInterval 0 disables
+func WithKeepalive(pingInterval, pongWait time.Duration) Option {
+	return func(h *Handler) {
+		h.pingInterval = pingInterval
+		h.pongWait = pongWait
+	}
+}
+
+// startKeepalive ping the client until stop is closed. Pongs are handled by clientDeadline
+func (h *Handler) startKeepalive(conn *websocket.Conn, writeTimeout time.Duration, stop <-chan struct{}, logger *zap.Logger) {
+	go func() {
+		ticker := time.NewTicker(h.pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, writeDeadline(writeTimeout)); err != nil {
+					logger.Debug("Failed to send ping", zap.Error(err))
+					return
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// WithSessionLimits close sessions without traffic in either direction for idleTimeout,
+// and sessions longer than maxLifetime. 0 disables. Destinations can override them
+func WithSessionLimits(idleTimeout, maxLifetime time.Duration) Option {
+	return func(h *Handler) {
+		h.idleTimeout = idleTimeout
+		h.maxLifetime = maxLifetime
+	}
+}
+
+// touch traffic in the session
+func (s *session) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *session) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+// idleTimer terminates an idle session. Stop it when the session ends
+type idleTimer struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+// closeIdle terminate the session after idleTimeout without traffic. The timer is
+// rescheduled for the rest of idleTimeout when there was traffic
+func closeIdle(sess *session, idleTimeout time.Duration, logger *zap.Logger) *idleTimer {
+	sess.touch()
+	it := &idleTimer{}
+	// the callback waits for it.timer to be set
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.timer = time.AfterFunc(idleTimeout, func() {
+		it.mu.Lock()
+		if it.stopped {
+			it.mu.Unlock()
+			return
+		}
+		if idle := sess.idle(); idle < idleTimeout {
+			it.timer.Reset(idleTimeout - idle)
+			it.mu.Unlock()
+			return
+		}
+		it.stopped = true
+		it.mu.Unlock()
+		logger.Info("Session is idle. Close session", zap.Duration("idle_timeout", idleTimeout))
+		sess.terminate("idle_timeout", websocket.CloseGoingAway, fmt.Sprintf("idle timeout (%s)", idleTimeout))
+	})
+	return it
+}
+
+// Stop the timer. It is not rescheduled after Stop
+func (it *idleTimer) Stop() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.stopped = true
+	it.timer.Stop()
+}
+
+// closeAfter terminate the session at maxLifetime
+func closeAfter(sess *session, maxLifetime time.Duration, logger *zap.Logger) *time.Timer {
+	return time.AfterFunc(maxLifetime, func() {
+		logger.Info("Session reached max lifetime. Close session", zap.Duration("max_lifetime", maxLifetime))
+		sess.terminate("max_lifetime", websocket.CloseGoingAway, fmt.Sprintf("max session lifetime (%s) exceeded", maxLifetime))
+	})
+}
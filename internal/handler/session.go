@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kazeburo/wsgate-server/internal/auth"
+	"github.com/kazeburo/wsgate-server/internal/mapping"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// maxReauthMessageSize limits the size of a re-authentication message
+const maxReauthMessageSize = 64 * 1024
+
+// closeControlTimeout time to send a close frame
+const closeControlTimeout = time.Second
+
+// WithTokenExpiry close sessions when the token expires after grace. With reauth,
+// clients can extend the session by sending a new token of the same subject in a text message
+func WithTokenExpiry(enabled bool, grace time.Duration, reauth bool) Option {
+	return func(h *Handler) {
+		h.expireSession = enabled
+		h.expireGrace = grace
+		h.reauth = reauth
+	}
+}
+
+// session a proxied connection which can be terminated from outside of the copy loops
+type session struct {
+	conn     *websocket.Conn
+	upstream net.Conn
+	logger   *zap.Logger
+
+	once       sync.Once
+	terminated int32
+	failed     int32
+	lastActive int64
+	mu         sync.Mutex
+	reason     string
+	id         *auth.Identity
+}
+
+func newSession(conn *websocket.Conn, upstream net.Conn, id *auth.Identity, logger *zap.Logger) *session {
+	return &session{conn: conn, upstream: upstream, id: id, logger: logger}
+}
+
+// terminate send a close frame with code and text to the client and close both connections.
+// reason is logged as disconnect_at. Only the first call has effect
+func (s *session) terminate(reason string, code int, text string) {
+	s.once.Do(func() {
+		s.disconnect(reason)
+		atomic.StoreInt32(&s.terminated, 1)
+		s.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, text),
+			time.Now().Add(closeControlTimeout))
+		s.upstream.Close()
+		s.conn.Close()
+	})
+}
+
+// finish one of the copy loops ended and the connections are being closed
+func (s *session) finish() {
+	atomic.StoreInt32(&s.terminated, 1)
+}
+
+// isTerminated terminate or finish is called. Errors of the copy loops are expected then
+func (s *session) isTerminated() bool {
+	return atomic.LoadInt32(&s.terminated) == 1
+}
+
+// fail the session ended by an unexpected error
+func (s *session) fail() {
+	atomic.StoreInt32(&s.failed, 1)
+}
+
+func (s *session) hasFailed() bool {
+	return atomic.LoadInt32(&s.failed) == 1
+}
+
+// disconnect record where the session is disconnected. The first reason is kept
+func (s *session) disconnect(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+}
+
+// disconnectReason the first reason given to disconnect or terminate
+func (s *session) disconnectReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason
+}
+
+// identity authorizing the session
+func (s *session) identity() *auth.Identity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+func (s *session) setIdentity(id *auth.Identity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.id = id
+}
+
+// register live session
+func (h *Handler) register(sess *session) {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+	h.sessions[sess] = struct{}{}
+}
+
+func (h *Handler) unregister(sess *session) {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+	delete(h.sessions, sess)
+}
+
+// CloseRevoked close live sessions whose identity is revoked now by the authenticator
+func (h *Handler) CloseRevoked() {
+	rv, ok := h.auth.(auth.Revoker)
+	if !ok {
+		return
+	}
+	h.sessionsMu.Lock()
+	sessions := make([]*session, 0, len(h.sessions))
+	for sess := range h.sessions {
+		sessions = append(sessions, sess)
+	}
+	h.sessionsMu.Unlock()
+
+	for _, sess := range sessions {
+		if err := rv.Revoked(sess.identity()); err != nil {
+			sess.logger.Warn("Token is revoked. Close session", zap.Error(err))
+			sess.terminate("revoked", websocket.ClosePolicyViolation, "token revoked")
+		}
+	}
+}
+
+// expireAfter time after exp to close the session. Not before the leeway ends, as the
+// token is still accepted until then
+func (h *Handler) expireAfter() time.Duration {
+	if leeway := h.pk.Leeway(); leeway > h.expireGrace {
+		return leeway
+	}
+	return h.expireGrace
+}
+
+// expireAt terminate the session when the token expires after grace or the leeway
+func (h *Handler) expireAt(sess *session, exp time.Time, logger *zap.Logger) *time.Timer {
+	return time.AfterFunc(time.Until(exp.Add(h.expireAfter())), func() {
+		logger.Info("Token expired. Close session", zap.Time("expires_at", exp))
+		sess.terminate("token_expired", websocket.ClosePolicyViolation, "token expired")
+	})
+}
+
+// reauthenticate verify a new token in the message r, authorize it for dest again and
+// extend the session to its expiry
+func (h *Handler) reauthenticate(r io.Reader, dest *mapping.Destination, subject string, expiry *time.Timer, logger *zap.Logger) (*auth.Identity, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxReauthMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(b))
+	id, err := h.pk.AuthenticateToken(token)
+	if err != nil {
+		return nil, errors.New(redact(err.Error(), token))
+	}
+	if id.Subject != subject {
+		return nil, errors.Errorf("subject changed: %q", id.Subject)
+	}
+	if !id.AllowDestination(dest.Name) {
+		logger.Warn("Forbidden by destination scope")
+		return nil, errors.New("forbidden by destination scope")
+	}
+	if rule, ok := dest.Authorize(id); !ok {
+		logger.Warn("Forbidden by authorization rule", zap.String("rule", rule))
+		return nil, errors.Errorf("forbidden by authorization rule %q", rule)
+	}
+	expiry.Reset(time.Until(id.ExpiresAt.Add(h.expireAfter())))
+	return id, nil
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WithReadTimeout close sessions when nothing is read from the client or from the
+// upstream for readTimeout, separately in each direction. 0 disables. Destinations
+// can override it
+func WithReadTimeout(readTimeout time.Duration) Option {
+	return func(h *Handler) {
+		h.readTimeout = readTimeout
+	}
+}
+
+// isTimeout err is by a deadline of the connection
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// deadlineWriter set the write deadline of conn before each write, so that a stalled
+// peer can not block the writer for longer than timeout
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+	err     error
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(writeDeadline(w.timeout))
+	n, err := w.conn.Write(p)
+	w.err = err
+	return n, err
+}
+
+// clientDeadline read deadline of the client: pongWait after the last pong or message
+// with keepalive, and readTimeout after the last message. Only for the reading goroutine,
+// which also runs the pong handler
+type clientDeadline struct {
+	conn        *websocket.Conn
+	pongWait    time.Duration
+	readTimeout time.Duration
+	lastPong    time.Time
+	lastMessage time.Time
+}
+
+// newClientDeadline set the first deadline and the pong handler. pongWait 0 disables keepalive
+func newClientDeadline(conn *websocket.Conn, pongWait, readTimeout time.Duration) *clientDeadline {
+	d := &clientDeadline{conn: conn, pongWait: pongWait, readTimeout: readTimeout}
+	if pongWait > 0 {
+		conn.SetPongHandler(func(string) error {
+			d.pong()
+			return nil
+		})
+	}
+	d.message()
+	return d
+}
+
+func (d *clientDeadline) pong() {
+	d.lastPong = time.Now()
+	d.set()
+}
+
+// message a message is read. It is a pong too
+func (d *clientDeadline) message() {
+	now := time.Now()
+	d.lastPong = now
+	d.lastMessage = now
+	d.set()
+}
+
+func (d *clientDeadline) set() {
+	var t time.Time
+	if d.pongWait > 0 {
+		t = d.lastPong.Add(d.pongWait)
+	}
+	if d.readTimeout > 0 {
+		if rt := d.lastMessage.Add(d.readTimeout); t.IsZero() || rt.Before(t) {
+			t = rt
+		}
+	}
+	if !t.IsZero() {
+		d.conn.SetReadDeadline(t)
+	}
+}
+
+// expired disconnect_at and the text of the close frame for the expired deadline
+func (d *clientDeadline) expired() (string, string) {
+	if d.readTimeout > 0 && time.Since(d.lastMessage) >= d.readTimeout {
+		return "client_read_timeout", "client read timeout"
+	}
+	return "ping_timeout", "ping timeout"
+}
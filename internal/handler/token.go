@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/kazeburo/wsgate-server/internal/apikey"
+	"github.com/kazeburo/wsgate-server/internal/auth"
+	"github.com/kazeburo/wsgate-server/internal/publickey"
+	"github.com/pkg/errors"
+)
+
+// TokenSubprotocolPrefix prefix of the WebSocket subprotocol with a token, as "bearer.<token>"
+const TokenSubprotocolPrefix = "bearer."
+
+const redacted = "[REDACTED]"
+
+// WithTokenTransport accept tokens also in the query parameter queryParam and in the
+// WebSocket subprotocol "bearer.<token>", for clients such as browsers that can not
+// set Authorization header. Empty queryParam disables the query parameter
+func WithTokenTransport(queryParam string, subprotocol bool) Option {
+	return func(h *Handler) {
+		h.tokenQueryParam = queryParam
+		h.tokenSubprotocol = subprotocol
+	}
+}
+
+// tokenAuthenticator verifies JWT in Authorization header, and the query parameter or
+// the subprotocol if enabled
+type tokenAuthenticator struct {
+	pk          *publickey.Publickey
+	queryParam  string
+	subprotocol bool
+}
+
+// Authenticate errors are redacted
+func (a *tokenAuthenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	token, subprotocol := a.bearerToken(r)
+	if token == "" {
+		return nil, auth.ErrNoCredentials
+	}
+	id, err := a.pk.AuthenticateToken(token)
+	if err != nil {
+		return nil, errors.New(redact(err.Error(), token))
+	}
+	id.Subprotocol = subprotocol
+	return id, nil
+}
+
+// Revoked implements auth.Revoker
+func (a *tokenAuthenticator) Revoked(id *auth.Identity) error {
+	return a.pk.Revoked(id)
+}
+
+// bearerToken token from Authorization header, the query parameter or the subprotocol
+// in this order. When the token is taken from the subprotocol, subprotocol is the one
+// to answer: the first other protocol the client offered, or the token protocol itself
+func (a *tokenAuthenticator) bearerToken(r *http.Request) (token, subprotocol string) {
+	if t := r.Header.Get("Authorization"); t != "" && !apikey.Present(t) {
+		return t, ""
+	}
+	if a.queryParam != "" {
+		if t := r.URL.Query().Get(a.queryParam); t != "" {
+			return t, ""
+		}
+	}
+	if !a.subprotocol {
+		return "", ""
+	}
+	for _, p := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(p, TokenSubprotocolPrefix) {
+			if token == "" {
+				token = strings.TrimPrefix(p, TokenSubprotocolPrefix)
+			}
+		} else if subprotocol == "" {
+			subprotocol = p
+		}
+	}
+	if token == "" {
+		return "", ""
+	}
+	if subprotocol == "" {
+		subprotocol = TokenSubprotocolPrefix + token
+	}
+	return token, subprotocol
+}
+
+// redact the token in s
+func redact(s, token string) string {
+	token = strings.TrimPrefix(token, "Bearer ")
+	if token == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, token, redacted)
+}
@@ -0,0 +1,103 @@
+package mapping
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kazeburo/wsgate-server/internal/auth"
+	"github.com/pkg/errors"
+)
+
+// authorization rule actions
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// RuleDefault name of the implicit rule that denies requests matching no rule
+const RuleDefault = "default"
+
+// Rule authorization rule. A rule matches when every condition set matches,
+// and a condition matches when any of its values matches
+type Rule struct {
+	Name         string   `yaml:"name" json:"name"`
+	Action       string   `yaml:"action" json:"action"`
+	Subjects     []string `yaml:"subjects" json:"subjects"`
+	EmailDomains []string `yaml:"email_domains" json:"email_domains"`
+	Groups       []string `yaml:"groups" json:"groups"`
+	Roles        []string `yaml:"roles" json:"roles"`
+}
+
+func (r *Rule) validate(i int) error {
+	if r.Name == "" {
+		r.Name = fmt.Sprintf("#%d", i+1)
+	}
+	if r.Action == "" {
+		r.Action = ActionAllow
+	}
+	if r.Action != ActionAllow && r.Action != ActionDeny {
+		return errors.Errorf("unknown action of rule %s: %s", r.Name, r.Action)
+	}
+	if len(r.Subjects) == 0 && len(r.EmailDomains) == 0 && len(r.Groups) == 0 && len(r.Roles) == 0 {
+		return errors.Errorf("rule %s has no condition", r.Name)
+	}
+	return nil
+}
+
+// match roles are taken from "roles" claim
+func (r *Rule) match(id *auth.Identity) bool {
+	if len(r.Subjects) > 0 && !anyEqual(r.Subjects, []string{id.Subject}) {
+		return false
+	}
+	if len(r.EmailDomains) > 0 {
+		at := strings.LastIndex(id.Email, "@")
+		if at < 0 || !anyEqualFold(r.EmailDomains, id.Email[at+1:]) {
+			return false
+		}
+	}
+	if len(r.Groups) > 0 && !anyEqual(r.Groups, id.Groups) {
+		return false
+	}
+	if len(r.Roles) > 0 && !anyEqual(r.Roles, auth.ClaimStrings(id.Claims, "roles")) {
+		return false
+	}
+	return true
+}
+
+// Authorize check the identity against allowed_users and the authorization rules.
+// Rules are evaluated in order and the first matching rule decides. Requests matching
+// no rule are denied by RuleDefault. Returns the name of the deciding rule
+func (d *Destination) Authorize(id *auth.Identity) (string, bool) {
+	if !d.AllowUser(id.Subject) {
+		return "allowed_users", false
+	}
+	if len(d.Authorization) == 0 {
+		return "", true
+	}
+	for _, r := range d.Authorization {
+		if r.match(id) {
+			return r.Name, r.Action == ActionAllow
+		}
+	}
+	return RuleDefault, false
+}
+
+func anyEqual(want, have []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if w == h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func anyEqualFold(want []string, have string) bool {
+	for _, w := range want {
+		if strings.EqualFold(w, have) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,316 @@
+package mapping
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Destination settings of a /proxy/{dest}
+type Destination struct {
+	Name             string
+	Upstreams        []string
+	DialTimeout      time.Duration
+	DialAttempts     int
+	DialTotalTimeout time.Duration
+	WriteTimeout     time.Duration
+	ReadTimeout      time.Duration
+	IdleTimeout      time.Duration
+	MaxLifetime      time.Duration
+	Compression      *bool
+	AllowedUsers     []string
+	Description      string
+	Balance          string
+	TLS              *TLSConfig
+	ProxyProtocol    int
+	Authorization    []Rule
+
+	pool      []*Upstream
+	rr        *uint64
+	tlsConfig *tls.Config
+}
+
+// String upstreams joined with comma, for logging
+func (d *Destination) String() string {
+	return strings.Join(d.Upstreams, ",")
+}
+
+// GetDialTimeout dial timeout of the destination or def
+func (d *Destination) GetDialTimeout(def time.Duration) time.Duration {
+	if d.DialTimeout > 0 {
+		return d.DialTimeout
+	}
+	return def
+}
+
+// GetDialAttempts max number of upstreams to try or def
+func (d *Destination) GetDialAttempts(def int) int {
+	if d.DialAttempts > 0 {
+		return d.DialAttempts
+	}
+	return def
+}
+
+// GetDialTotalTimeout time budget for all dial attempts or def
+func (d *Destination) GetDialTotalTimeout(def time.Duration) time.Duration {
+	if d.DialTotalTimeout > 0 {
+		return d.DialTotalTimeout
+	}
+	return def
+}
+
+// GetWriteTimeout write timeout of the destination or def
+func (d *Destination) GetWriteTimeout(def time.Duration) time.Duration {
+	if d.WriteTimeout > 0 {
+		return d.WriteTimeout
+	}
+	return def
+}
+
+// GetReadTimeout read timeout of the destination or def
+func (d *Destination) GetReadTimeout(def time.Duration) time.Duration {
+	if d.ReadTimeout > 0 {
+		return d.ReadTimeout
+	}
+	return def
+}
+
+// GetIdleTimeout time to close sessions without traffic in either direction or def
+func (d *Destination) GetIdleTimeout(def time.Duration) time.Duration {
+	if d.IdleTimeout > 0 {
+		return d.IdleTimeout
+	}
+	return def
+}
+
+// GetMaxLifetime max duration of sessions of the destination or def
+func (d *Destination) GetMaxLifetime(def time.Duration) time.Duration {
+	if d.MaxLifetime > 0 {
+		return d.MaxLifetime
+	}
+	return def
+}
+
+// GetCompression compression setting of the destination or def
+func (d *Destination) GetCompression(def bool) bool {
+	if d.Compression != nil {
+		return *d.Compression
+	}
+	return def
+}
+
+// AllowUser user is allowed to use the destination. All users are allowed if AllowedUsers is empty
+func (d *Destination) AllowUser(user string) bool {
+	if len(d.AllowedUsers) == 0 {
+		return true
+	}
+	for _, u := range d.AllowedUsers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Destination) validate() error {
+	if d.Name == "" {
+		return errors.New("empty name")
+	}
+	if len(d.Upstreams) == 0 {
+		return errors.Errorf("no upstream: %s", d.Name)
+	}
+	seen := make(map[string]bool)
+	for _, addr := range d.Upstreams {
+		u, err := parseUpstream(addr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid upstream of %s", d.Name)
+		}
+		if seen[u.String()] {
+			return errors.Errorf("duplicated upstream of %s: %s", d.Name, addr)
+		}
+		seen[u.String()] = true
+		// a socket path has no host to verify the certificate against
+		if u.Network == "unix" && d.TLS != nil && d.TLS.Enabled && d.TLS.ServerName == "" && !d.TLS.InsecureSkipVerify {
+			return errors.Errorf("tls of %s requires server_name for unix upstream %s", d.Name, addr)
+		}
+	}
+	if err := validateBalance(d.Balance); err != nil {
+		return errors.Wrapf(err, "invalid balance of %s", d.Name)
+	}
+	for i := range d.Authorization {
+		if err := d.Authorization[i].validate(i); err != nil {
+			return errors.Wrapf(err, "invalid authorization of %s", d.Name)
+		}
+	}
+	if d.ProxyProtocol != 0 && d.ProxyProtocol != 1 && d.ProxyProtocol != 2 {
+		return errors.Errorf("proxy_protocol of %s must be 1 or 2", d.Name)
+	}
+	if d.DialAttempts < 0 {
+		return errors.Errorf("negative dial_attempts: %s", d.Name)
+	}
+	if d.DialTimeout < 0 || d.DialTotalTimeout < 0 || d.WriteTimeout < 0 || d.ReadTimeout < 0 ||
+		d.IdleTimeout < 0 || d.MaxLifetime < 0 {
+		return errors.Errorf("negative timeout: %s", d.Name)
+	}
+	return nil
+}
+
+// sameConfig compare settings, ignoring runtime state
+func (d *Destination) sameConfig(o *Destination) bool {
+	a, b := *d, *o
+	a.pool, b.pool = nil, nil
+	a.rr, b.rr = nil, nil
+	a.tlsConfig, b.tlsConfig = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// destinationConfig a destination in YAML/JSON map file
+type destinationConfig struct {
+	Name             string     `yaml:"name" json:"name"`
+	Upstreams        []string   `yaml:"upstreams" json:"upstreams"`
+	DialTimeout      string     `yaml:"dial_timeout" json:"dial_timeout"`
+	DialAttempts     int        `yaml:"dial_attempts" json:"dial_attempts"`
+	DialTotalTimeout string     `yaml:"dial_total_timeout" json:"dial_total_timeout"`
+	WriteTimeout     string     `yaml:"write_timeout" json:"write_timeout"`
+	ReadTimeout      string     `yaml:"read_timeout" json:"read_timeout"`
+	IdleTimeout      string     `yaml:"idle_timeout" json:"idle_timeout"`
+	MaxLifetime      string     `yaml:"max_lifetime" json:"max_lifetime"`
+	Compression      *bool      `yaml:"compression" json:"compression"`
+	AllowedUsers     []string   `yaml:"allowed_users" json:"allowed_users"`
+	Description      string     `yaml:"description" json:"description"`
+	Balance          string     `yaml:"balance" json:"balance"`
+	TLS              *TLSConfig `yaml:"tls" json:"tls"`
+	ProxyProtocol    int        `yaml:"proxy_protocol" json:"proxy_protocol"`
+	Authorization    []Rule     `yaml:"authorization" json:"authorization"`
+}
+
+type mapConfig struct {
+	Destinations []destinationConfig `yaml:"destinations" json:"destinations"`
+}
+
+func (dc destinationConfig) destination() (*Destination, error) {
+	d := &Destination{
+		Name:          dc.Name,
+		Upstreams:     dc.Upstreams,
+		DialAttempts:  dc.DialAttempts,
+		Compression:   dc.Compression,
+		AllowedUsers:  dc.AllowedUsers,
+		Description:   dc.Description,
+		Balance:       dc.Balance,
+		TLS:           dc.TLS,
+		ProxyProtocol: dc.ProxyProtocol,
+		Authorization: dc.Authorization,
+	}
+	durations := []struct {
+		key string
+		src string
+		dst *time.Duration
+	}{
+		{"dial_timeout", dc.DialTimeout, &d.DialTimeout},
+		{"dial_total_timeout", dc.DialTotalTimeout, &d.DialTotalTimeout},
+		{"write_timeout", dc.WriteTimeout, &d.WriteTimeout},
+		{"read_timeout", dc.ReadTimeout, &d.ReadTimeout},
+		{"idle_timeout", dc.IdleTimeout, &d.IdleTimeout},
+		{"max_lifetime", dc.MaxLifetime, &d.MaxLifetime},
+	}
+	for _, du := range durations {
+		if du.src == "" {
+			continue
+		}
+		v, err := time.ParseDuration(du.src)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s of %s", du.key, dc.Name)
+		}
+		*du.dst = v
+	}
+	tlsConfig, err := dc.TLS.build()
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid tls of %s", dc.Name)
+	}
+	d.tlsConfig = tlsConfig
+	return d, nil
+}
+
+// parse map file. The format is chosen by the extension of mapFile
+func parse(mapFile string, b []byte) (map[string]*Destination, error) {
+	switch strings.ToLower(filepath.Ext(mapFile)) {
+	case ".yaml", ".yml":
+		var c mapConfig
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(&c); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse YAML mapFile")
+		}
+		return c.destinations()
+	case ".json":
+		var c mapConfig
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse JSON mapFile")
+		}
+		return c.destinations()
+	default:
+		return parseText(b)
+	}
+}
+
+func (c mapConfig) destinations() (map[string]*Destination, error) {
+	m := make(map[string]*Destination)
+	for i, dc := range c.Destinations {
+		d, err := dc.destination()
+		if err != nil {
+			return nil, err
+		}
+		if err := d.validate(); err != nil {
+			return nil, errors.Wrapf(err, "Invalid destination #%d", i+1)
+		}
+		if _, ok := m[d.Name]; ok {
+			return nil, errors.Errorf("Duplicated name: %s", d.Name)
+		}
+		m[d.Name] = d
+	}
+	return m, nil
+}
+
+// parseText parse "name,host:port" lines
+func parseText(b []byte) (map[string]*Destination, error) {
+	m := make(map[string]*Destination)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	n := 0
+	for s.Scan() {
+		n++
+		if commentRe.MatchString(s.Text()) || strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		l := strings.SplitN(s.Text(), ",", 2)
+		if len(l) != 2 {
+			return nil, errors.Errorf("Invalid line %d: %s", n, s.Text())
+		}
+		if l[0] == "" {
+			return nil, errors.Errorf("Empty name at line %d", n)
+		}
+		if _, ok := m[l[0]]; ok {
+			return nil, errors.Errorf("Duplicated name at line %d: %s", n, l[0])
+		}
+		if _, err := parseUpstream(l[1]); err != nil {
+			return nil, errors.Wrapf(err, "Invalid upstream at line %d", n)
+		}
+		m[l[0]] = &Destination{
+			Name:      l[0],
+			Upstreams: []string{l[1]},
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to read mapFile")
+	}
+	return m, nil
+}
@@ -0,0 +1,156 @@
+package mapping
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HealthCheckConfig settings of active health checks
+type HealthCheckConfig struct {
+	// Interval between checks. 0 disables health checks
+	Interval time.Duration
+	// Timeout of a TCP connect
+	Timeout time.Duration
+	// Rise consecutive successes to mark an upstream up
+	Rise int
+	// Fall consecutive failures to mark an upstream down
+	Fall int
+}
+
+// UpstreamStatus status of an upstream, for the status endpoint
+type UpstreamStatus struct {
+	Destination string     `json:"destination"`
+	Upstream    string     `json:"upstream"`
+	Healthy     bool       `json:"healthy"`
+	Ejected     bool       `json:"ejected"`
+	Active      int64      `json:"active"`
+	LastCheck   *time.Time `json:"last_check,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// Healthy upstream is not marked down by health checks
+func (u *Upstream) Healthy() bool {
+	return atomic.LoadInt32(&u.state.down) == 0
+}
+
+// check result of a probe. returns true if the health state changed
+func (st *upstreamState) check(err error, cfg HealthCheckConfig) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastCheck = time.Now()
+	down := atomic.LoadInt32(&st.down) == 1
+	if err != nil {
+		st.lastError = err.Error()
+		st.successes = 0
+		st.failures++
+		if !down && st.failures >= cfg.Fall {
+			atomic.StoreInt32(&st.down, 1)
+			return true
+		}
+		return false
+	}
+	st.lastError = ""
+	st.failures = 0
+	st.successes++
+	if down && st.successes >= cfg.Rise {
+		atomic.StoreInt32(&st.down, 0)
+		return true
+	}
+	return false
+}
+
+// HealthCheck probes every upstream in the table by TCP connect until ctx is done
+func (mp *Mapping) HealthCheck(ctx context.Context, cfg HealthCheckConfig) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	if cfg.Rise <= 0 {
+		cfg.Rise = 1
+	}
+	if cfg.Fall <= 0 {
+		cfg.Fall = 1
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		mp.probeAll(cfg)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (mp *Mapping) probeAll(cfg HealthCheckConfig) {
+	wg := &sync.WaitGroup{}
+	for _, u := range mp.upstreams() {
+		wg.Add(1)
+		go func(u *Upstream) {
+			defer wg.Done()
+			c, err := net.DialTimeout(u.Network, u.Address, cfg.Timeout)
+			if err == nil {
+				c.Close()
+			}
+			if !u.state.check(err, cfg) {
+				return
+			}
+			if u.Healthy() {
+				mp.logger.Info("Upstream is up", zap.String("upstream", u.String()))
+			} else {
+				mp.logger.Warn("Upstream is down", zap.String("upstream", u.String()), zap.Error(err))
+			}
+		}(u)
+	}
+	wg.Wait()
+}
+
+// upstreams unique upstreams in the current table
+func (mp *Mapping) upstreams() []*Upstream {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	seen := make(map[*upstreamState]bool)
+	var us []*Upstream
+	for _, d := range mp.m {
+		for _, u := range d.pool {
+			if seen[u.state] {
+				continue
+			}
+			seen[u.state] = true
+			us = append(us, u)
+		}
+	}
+	return us
+}
+
+// Status status of all upstreams, sorted by destination
+func (mp *Mapping) Status() []UpstreamStatus {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	var ss []UpstreamStatus
+	for _, name := range sortedKeys(mp.m) {
+		for _, u := range mp.m[name].pool {
+			st := UpstreamStatus{
+				Destination: name,
+				Upstream:    u.String(),
+				Healthy:     u.Healthy(),
+				Ejected:     u.Ejected(),
+				Active:      u.Active(),
+			}
+			u.state.mu.Lock()
+			if !u.state.lastCheck.IsZero() {
+				lastCheck := u.state.lastCheck
+				st.LastCheck = &lastCheck
+			}
+			st.LastError = u.state.lastError
+			u.state.mu.Unlock()
+			ss = append(ss, st)
+		}
+	}
+	return ss
+}
@@ -1,56 +1,279 @@
 package mapping
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"net"
 	"os"
 	"regexp"
-	"strings"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+var commentRe = regexp.MustCompile(`^ *#`)
+
 // Mapping struct
 type Mapping struct {
-	m map[string]string
+	mapFile string
+	logger  *zap.Logger
+	mu      sync.RWMutex
+	m       map[string]*Destination
+	states  map[string]*upstreamState
+	hash    [sha256.Size]byte
+	modTime time.Time
+	size    int64
 }
 
 // New new mapping
 func New(mapFile string, logger *zap.Logger) (*Mapping, error) {
-	r := regexp.MustCompile(`^ *#`)
-	m := make(map[string]string)
+	mp := &Mapping{
+		mapFile: mapFile,
+		logger:  logger,
+		m:       make(map[string]*Destination),
+		states:  make(map[string]*upstreamState),
+	}
 	if mapFile != "" {
-		f, err := os.Open(mapFile)
+		fi, b, err := mp.read()
+		if err != nil {
+			return nil, err
+		}
+		m, err := parse(mapFile, b)
 		if err != nil {
-			return nil, errors.Wrap(err, "Failed to open mapFile")
+			return nil, err
 		}
-		s := bufio.NewScanner(f)
-		for s.Scan() {
-			if r.MatchString(s.Text()) {
-				continue
+		mp.attach(m)
+		for _, k := range sortedKeys(m) {
+			logger.Info("Created map",
+				zap.String("from", k),
+				zap.String("to", m[k].String()))
+		}
+		mp.m = m
+		mp.hash = sha256.Sum256(b)
+		mp.modTime = fi.ModTime()
+		mp.size = fi.Size()
+	}
+	return mp, nil
+}
+
+// Reload re-read mapFile and swap the table. The current table is kept on error.
+// The table is rebuilt even if mapFile is not modified, to reload the TLS files
+func (mp *Mapping) Reload() error {
+	if mp.mapFile == "" {
+		return nil
+	}
+	fi, b, err := mp.read()
+	if err != nil {
+		return err
+	}
+	return mp.apply(fi, b, true)
+}
+
+// Watch polls mapFile every interval and reloads it when the content changes
+func (mp *Mapping) Watch(ctx context.Context, interval time.Duration) {
+	if mp.mapFile == "" || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := mp.check(); err != nil {
+				mp.logger.Error("Failed to reload map. Keep current map",
+					zap.String("map", mp.mapFile),
+					zap.Error(err))
 			}
-			l := strings.SplitN(s.Text(), ",", 2)
-			if len(l) != 2 {
-				return nil, errors.Wrapf(err, "Invalid line: %s", s.Text())
+		}
+	}
+}
+
+func (mp *Mapping) check() error {
+	fi, err := os.Stat(mp.mapFile)
+	if err != nil {
+		return errors.Wrap(err, "Failed to stat mapFile")
+	}
+	mp.mu.RLock()
+	unchanged := fi.ModTime().Equal(mp.modTime) && fi.Size() == mp.size
+	mp.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	fi, b, err := mp.read()
+	if err != nil {
+		return err
+	}
+	return mp.apply(fi, b, false)
+}
+
+func (mp *Mapping) read() (os.FileInfo, []byte, error) {
+	f, err := os.Open(mp.mapFile)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to open mapFile")
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to stat mapFile")
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(f); err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to read mapFile")
+	}
+	return fi, buf.Bytes(), nil
+}
+
+// apply parse b and swap the table. Unless force, b is not parsed if it is not modified
+func (mp *Mapping) apply(fi os.FileInfo, b []byte, force bool) error {
+	hash := sha256.Sum256(b)
+	mp.mu.RLock()
+	sameHash := hash == mp.hash
+	mp.mu.RUnlock()
+	if sameHash && !force {
+		// touched but not modified
+		mp.mu.Lock()
+		mp.modTime = fi.ModTime()
+		mp.size = fi.Size()
+		mp.mu.Unlock()
+		return nil
+	}
+
+	m, err := parse(mp.mapFile, b)
+	if err != nil {
+		// remember the broken file to avoid logging the same error on every poll
+		mp.mu.Lock()
+		mp.modTime = fi.ModTime()
+		mp.size = fi.Size()
+		mp.mu.Unlock()
+		return err
+	}
+
+	mp.mu.Lock()
+	mp.attach(m)
+	mp.prune(m)
+	old := mp.m
+	mp.m = m
+	mp.hash = hash
+	mp.modTime = fi.ModTime()
+	mp.size = fi.Size()
+	mp.mu.Unlock()
+
+	mp.logDiff(old, m)
+	mp.logger.Info("Reloaded map",
+		zap.String("map", mp.mapFile),
+		zap.Int("entries", len(m)))
+	return nil
+}
+
+func (mp *Mapping) logDiff(old, m map[string]*Destination) {
+	for _, k := range sortedKeys(m) {
+		prev, ok := old[k]
+		if !ok {
+			mp.logger.Info("Added map",
+				zap.String("from", k),
+				zap.String("to", m[k].String()))
+			continue
+		}
+		if !prev.sameConfig(m[k]) {
+			mp.logger.Info("Changed map",
+				zap.String("from", k),
+				zap.String("to", m[k].String()),
+				zap.String("previous", prev.String()))
+		}
+	}
+	for _, k := range sortedKeys(old) {
+		if _, ok := m[k]; !ok {
+			mp.logger.Info("Removed map",
+				zap.String("from", k),
+				zap.String("to", old[k].String()))
+		}
+	}
+}
+
+// attach build upstream pools. Upstreams with the same address share their
+// state across reloads, so active sessions are still counted. mp.mu must be held
+// or mp must not be shared yet
+func (mp *Mapping) attach(m map[string]*Destination) {
+	for _, d := range m {
+		d.pool = make([]*Upstream, len(d.Upstreams))
+		for i, addr := range d.Upstreams {
+			// validated by parse
+			u, _ := parseUpstream(addr)
+			st, ok := mp.states[u.String()]
+			if !ok {
+				st = &upstreamState{}
+				mp.states[u.String()] = st
 			}
-			logger.Info("Created map",
-				zap.String("from", l[0]),
-				zap.String("to", l[1]))
-			m[l[0]] = l[1]
+			u.state = st
+			d.pool[i] = u
 		}
+		d.rr = new(uint64)
 	}
-	return &Mapping{
-		m: m,
-	}, nil
+}
+
+// prune forget the state of upstreams not in m. Sessions to removed upstreams keep
+// their state until they end, but are not counted if the upstream is added again.
+// mp.mu must be held
+func (mp *Mapping) prune(m map[string]*Destination) {
+	used := make(map[string]bool)
+	for _, d := range m {
+		for _, u := range d.pool {
+			used[u.String()] = true
+		}
+	}
+	for addr := range mp.states {
+		if !used[addr] {
+			delete(mp.states, addr)
+		}
+	}
+}
+
+func validateHostPort(hostport string) error {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.Errorf("empty host: %s", hostport)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return errors.Errorf("invalid port: %s", hostport)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]*Destination) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 // Get get mapping
-func (mp *Mapping) Get(proxyDest string) (string, bool) {
-	upstream, ok := mp.m[proxyDest]
-	return upstream, ok
+func (mp *Mapping) Get(proxyDest string) (*Destination, bool) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	d, ok := mp.m[proxyDest]
+	return d, ok
 }
 
 // Set mapping
 func (mp *Mapping) Set(proxyDest string, upstream string) {
-	mp.m[proxyDest] = upstream
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	d := &Destination{
+		Name:      proxyDest,
+		Upstreams: []string{upstream},
+	}
+	mp.attach(map[string]*Destination{proxyDest: d})
+	mp.m[proxyDest] = d
 }
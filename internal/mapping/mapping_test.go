@@ -0,0 +1,452 @@
+package mapping
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kazeburo/wsgate-server/internal/auth"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func writeMap(t *testing.T, path, body string) {
+	t.Helper()
+	assert.NoError(t, os.WriteFile(path, []byte(body), 0o644))
+}
+
+func TestReload(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "map.txt")
+	writeMap(t, mapFile, "# comment\nmysql,127.0.0.1:3306\n")
+
+	mp, err := New(mapFile, zap.NewNop())
+	assert.NoError(t, err)
+	d, ok := mp.Get("mysql")
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:3306", d.String())
+
+	writeMap(t, mapFile, "mysql,127.0.0.1:3307\nssh,127.0.0.1:22\n")
+	assert.NoError(t, mp.Reload())
+	d, _ = mp.Get("mysql")
+	assert.Equal(t, "127.0.0.1:3307", d.String())
+	_, ok = mp.Get("ssh")
+	assert.True(t, ok)
+
+	// state of removed upstreams is dropped
+	assert.Len(t, mp.states, 2)
+	assert.NotContains(t, mp.states, "127.0.0.1:3306")
+
+	// broken file keeps current table
+	writeMap(t, mapFile, "mysql\n")
+	assert.Error(t, mp.Reload())
+	d, _ = mp.Get("mysql")
+	assert.Equal(t, "127.0.0.1:3307", d.String())
+}
+
+func TestParseValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"duplicate", "mysql,127.0.0.1:3306\nmysql,127.0.0.1:3307\n", "Duplicated name"},
+		{"empty name", ",127.0.0.1:3306\n", "Empty name"},
+		{"no port", "mysql,127.0.0.1\n", "Invalid upstream"},
+		{"bad port", "mysql,127.0.0.1:http\n", "Invalid upstream"},
+		{"no host", "mysql,:3306\n", "Invalid upstream"},
+		{"no comma", "mysql\n", "Invalid line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse("map.txt", []byte(tt.body))
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+
+	m, err := parse("map.txt", []byte("# comment\n\nmysql,127.0.0.1:3306\nssh,[::1]:22\n"))
+	assert.NoError(t, err)
+	assert.Len(t, m, 2)
+}
+
+func TestWatch(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "map.txt")
+	writeMap(t, mapFile, "mysql,127.0.0.1:3306\n")
+
+	mp, err := New(mapFile, zap.NewNop())
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mp.Watch(ctx, 10*time.Millisecond)
+
+	writeMap(t, mapFile, "mysql,127.0.0.1:3306\nssh,127.0.0.1:22\n")
+	// make sure mtime differs on coarse filesystems
+	future := time.Now().Add(time.Second)
+	assert.NoError(t, os.Chtimes(mapFile, future, future))
+
+	assert.Eventually(t, func() bool {
+		_, ok := mp.Get("ssh")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestStructuredFormat(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlFile := filepath.Join(dir, "map.yaml")
+	writeMap(t, yamlFile, `
+destinations:
+  - name: mysql
+    description: MySQL primary
+    upstreams: [127.0.0.1:3306]
+    dial_timeout: 3s
+    write_timeout: 30s
+    read_timeout: 1h
+    max_lifetime: 12h
+    compression: true
+    allowed_users: [alice@example.com]
+  - name: ssh
+    upstreams: [127.0.0.1:22]
+    idle_timeout: 30m
+`)
+	mp, err := New(yamlFile, zap.NewNop())
+	assert.NoError(t, err)
+	d, ok := mp.Get("mysql")
+	assert.True(t, ok)
+	assert.Equal(t, "MySQL primary", d.Description)
+	assert.Equal(t, 3*time.Second, d.GetDialTimeout(10*time.Second))
+	assert.Equal(t, 30*time.Second, d.GetWriteTimeout(10*time.Second))
+	assert.Equal(t, time.Hour, d.GetReadTimeout(0))
+	assert.Equal(t, 12*time.Hour, d.GetMaxLifetime(0))
+	assert.Equal(t, time.Hour, d.GetIdleTimeout(time.Hour))
+	assert.True(t, d.GetCompression(false))
+	assert.True(t, d.AllowUser("alice@example.com"))
+	assert.False(t, d.AllowUser("bob@example.com"))
+
+	d, _ = mp.Get("ssh")
+	assert.Equal(t, 10*time.Second, d.GetDialTimeout(10*time.Second))
+	assert.Equal(t, 30*time.Minute, d.GetIdleTimeout(time.Hour))
+	assert.False(t, d.GetCompression(false))
+	assert.True(t, d.AllowUser("bob@example.com"))
+
+	jsonFile := filepath.Join(dir, "map.json")
+	writeMap(t, jsonFile, `{"destinations":[{"name":"mysql","upstreams":["127.0.0.1:3306"],"dial_timeout":"1s"}]}`)
+	mp, err = New(jsonFile, zap.NewNop())
+	assert.NoError(t, err)
+	d, _ = mp.Get("mysql")
+	assert.Equal(t, time.Second, d.DialTimeout)
+
+	writeMap(t, jsonFile, `{"destinations":[{"name":"mysql","upstreams":["127.0.0.1:3306"]},{"name":"mysql","upstreams":["127.0.0.1:3307"]}]}`)
+	_, err = New(jsonFile, zap.NewNop())
+	assert.ErrorContains(t, err, "Duplicated name")
+
+	writeMap(t, yamlFile, "destinations:\n  - name: mysql\n    upstream: 127.0.0.1:3306\n")
+	_, err = New(yamlFile, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func newPool(t *testing.T, balance string, upstreams ...string) *Destination {
+	t.Helper()
+	mp, err := New("", zap.NewNop())
+	assert.NoError(t, err)
+	d := &Destination{Name: "pool", Upstreams: upstreams, Balance: balance}
+	assert.NoError(t, d.validate())
+	mp.attach(map[string]*Destination{"pool": d})
+	return d
+}
+
+func TestSelect(t *testing.T) {
+	upstreams := []string{"127.0.0.1:3306", "127.0.0.2:3306", "127.0.0.3:3306"}
+
+	d := newPool(t, BalanceRoundRobin, upstreams...)
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, upstreams[i%3], d.Candidates(SelectKey{})[0].Address)
+	}
+
+	d = newPool(t, BalanceRandom, upstreams...)
+	for i := 0; i < 6; i++ {
+		assert.Contains(t, upstreams, d.Candidates(SelectKey{})[0].Address)
+	}
+
+	d = newPool(t, BalanceLeastConn, upstreams...)
+	d.pool[0].Acquire()
+	d.pool[2].Acquire()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, upstreams[1], d.Candidates(SelectKey{})[0].Address)
+	}
+
+	d = newPool(t, BalanceHashUser, upstreams...)
+	u := d.Candidates(SelectKey{User: "alice@example.com"})[0]
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, u, d.Candidates(SelectKey{User: "alice@example.com", ClientIP: "192.0.2.1"})[0])
+	}
+	// removing another member keeps the assignment
+	var rest []string
+	for _, addr := range upstreams {
+		if addr == u.Address || len(rest) == 0 {
+			rest = append(rest, addr)
+		}
+	}
+	d = newPool(t, BalanceHashUser, rest...)
+	assert.Equal(t, u.Address, d.Candidates(SelectKey{User: "alice@example.com"})[0].Address)
+
+	d = newPool(t, BalanceHashClientIP, upstreams...)
+	u = d.Candidates(SelectKey{ClientIP: "192.0.2.1"})[0]
+	assert.Equal(t, u, d.Candidates(SelectKey{User: "bob@example.com", ClientIP: "192.0.2.1"})[0])
+
+	d = &Destination{Name: "pool", Upstreams: upstreams, Balance: "weighted"}
+	assert.Error(t, d.validate())
+}
+
+func TestHealthCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	mapFile := filepath.Join(t.TempDir(), "map.yaml")
+	writeMap(t, mapFile, fmt.Sprintf(`
+destinations:
+  - name: pool
+    upstreams: [%s, %s]
+  - name: down
+    upstreams: [%s]
+`, l.Addr().String(), deadAddr, deadAddr))
+	mp, err := New(mapFile, zap.NewNop())
+	assert.NoError(t, err)
+
+	cfg := HealthCheckConfig{Timeout: time.Second, Rise: 1, Fall: 2}
+	mp.probeAll(cfg)
+	d, _ := mp.Get("down")
+	assert.Len(t, d.Candidates(SelectKey{}), 1, "not down before fall")
+
+	mp.probeAll(cfg)
+	assert.Empty(t, d.Candidates(SelectKey{}))
+	d, _ = mp.Get("pool")
+	c := d.Candidates(SelectKey{})
+	assert.Len(t, c, 1)
+	assert.Equal(t, l.Addr().String(), c[0].Address)
+
+	status := mp.Status()
+	assert.Len(t, status, 3)
+	assert.Equal(t, "down", status[0].Destination)
+	assert.False(t, status[0].Healthy)
+	assert.NotEmpty(t, status[0].LastError)
+	assert.NotNil(t, status[0].LastCheck)
+}
+
+func TestOutlierDetection(t *testing.T) {
+	d := newPool(t, BalanceRoundRobin, "127.0.0.1:3306", "127.0.0.2:3306")
+	u := d.pool[0]
+
+	assert.Zero(t, u.ReportFailure(2, time.Minute))
+	u.ReportSuccess()
+	assert.Zero(t, u.ReportFailure(2, time.Minute), "success resets the count")
+	assert.Equal(t, time.Minute, u.ReportFailure(2, time.Minute))
+	assert.True(t, u.Ejected())
+	assert.False(t, u.Available())
+
+	c := d.Candidates(SelectKey{})
+	assert.Len(t, c, 1)
+	assert.Equal(t, "127.0.0.2:3306", c[0].Address)
+
+	// backoff grows while the upstream keeps failing
+	u = d.pool[1]
+	assert.Equal(t, 10*time.Millisecond, u.ReportFailure(1, 10*time.Millisecond))
+	assert.Empty(t, d.Candidates(SelectKey{}))
+	assert.Eventually(t, func() bool { return !u.Ejected() }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 20*time.Millisecond, u.ReportFailure(1, 10*time.Millisecond))
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		in      string
+		network string
+		address string
+		str     string
+	}{
+		{"127.0.0.1:3306", "tcp", "127.0.0.1:3306", "127.0.0.1:3306"},
+		{"tcp://127.0.0.1:3306", "tcp", "127.0.0.1:3306", "127.0.0.1:3306"},
+		{"unix:/var/run/mysqld/mysqld.sock", "unix", "/var/run/mysqld/mysqld.sock", "unix:/var/run/mysqld/mysqld.sock"},
+		{"unix:///var/run/docker.sock", "unix", "/var/run/docker.sock", "unix:/var/run/docker.sock"},
+	}
+	for _, tt := range tests {
+		u, err := parseUpstream(tt.in)
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.network, u.Network, tt.in)
+		assert.Equal(t, tt.address, u.Address, tt.in)
+		assert.Equal(t, tt.str, u.String(), tt.in)
+	}
+	for _, in := range []string{"unix:", "tcp://127.0.0.1", "udp://127.0.0.1:53"} {
+		_, err := parseUpstream(in)
+		assert.Error(t, err, in)
+	}
+
+	// same socket in two notations
+	_, err := parse("map.txt", []byte("mysql,unix:/tmp/mysql.sock\n"))
+	assert.NoError(t, err)
+	d := &Destination{Name: "mysql", Upstreams: []string{"unix:/tmp/mysql.sock", "unix:///tmp/mysql.sock"}}
+	assert.ErrorContains(t, d.validate(), "duplicated upstream")
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeMap(t, caFile, "not a certificate")
+
+	mapFile := filepath.Join(dir, "map.yaml")
+	for _, body := range []string{
+		"{enabled: true, ca_file: " + filepath.Join(dir, "missing.pem") + "}",
+		"{enabled: true, ca_file: " + caFile + "}",
+		"{enabled: true, cert_file: " + caFile + "}",
+	} {
+		writeMap(t, mapFile, "destinations:\n  - name: db\n    upstreams: [127.0.0.1:5432]\n    tls: "+body+"\n")
+		_, err := New(mapFile, zap.NewNop())
+		assert.ErrorContains(t, err, "invalid tls of db", body)
+	}
+
+	writeMap(t, mapFile, "destinations:\n  - name: db\n    upstreams: [127.0.0.1:5432]\n    tls: {enabled: true, server_name: db.example.com}\n")
+	mp, err := New(mapFile, zap.NewNop())
+	assert.NoError(t, err)
+	d, _ := mp.Get("db")
+	assert.True(t, d.TLSEnabled())
+	assert.Equal(t, "db.example.com", d.TLSConfig().ServerName)
+
+	for _, tt := range []struct {
+		tls string
+		err string
+	}{
+		{"{enabled: true}", "requires server_name for unix upstream"},
+		{"{enabled: true, server_name: db.example.com}", ""},
+		{"{enabled: true, insecure_skip_verify: true}", ""},
+	} {
+		writeMap(t, mapFile, "destinations:\n  - name: db\n    upstreams: [unix:/tmp/db.sock]\n    tls: "+tt.tls+"\n")
+		_, err := New(mapFile, zap.NewNop())
+		if tt.err == "" {
+			assert.NoError(t, err, tt.tls)
+		} else {
+			assert.ErrorContains(t, err, tt.err, tt.tls)
+		}
+	}
+
+	d = newPool(t, "", "127.0.0.1:5432")
+	assert.False(t, d.TLSEnabled())
+	assert.Nil(t, d.TLSConfig())
+}
+
+func writeCA(t *testing.T, path string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "wsgate test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	writeMap(t, path, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+}
+
+func TestReloadTLSFiles(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeCA(t, caFile)
+	mapFile := filepath.Join(dir, "map.yaml")
+	writeMap(t, mapFile, "destinations:\n  - name: db\n    upstreams: [127.0.0.1:5432]\n    tls: {enabled: true, ca_file: "+caFile+"}\n")
+
+	mp, err := New(mapFile, zap.NewNop())
+	assert.NoError(t, err)
+	d, _ := mp.Get("db")
+	before := d.TLSConfig().RootCAs
+
+	// rotated CA with the same map file
+	writeCA(t, caFile)
+	assert.NoError(t, mp.Reload())
+	d, _ = mp.Get("db")
+	assert.False(t, before.Equal(d.TLSConfig().RootCAs))
+
+	// broken CA keeps current table
+	writeMap(t, caFile, "not a certificate")
+	assert.ErrorContains(t, mp.Reload(), "invalid tls of db")
+	d2, _ := mp.Get("db")
+	assert.Same(t, d, d2)
+}
+
+func TestAuthorize(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "map.yaml")
+	writeMap(t, mapFile, `
+destinations:
+  - name: db
+    upstreams: [127.0.0.1:3306]
+    authorization:
+      - name: no-contractors
+        action: deny
+        groups: [contractors]
+      - name: dba
+        groups: [dba]
+      - name: admins
+        email_domains: [example.com]
+        roles: [admin]
+      - subjects: [robot]
+  - name: open
+    upstreams: [127.0.0.1:22]
+`)
+	mp, err := New(mapFile, zap.NewNop())
+	assert.NoError(t, err)
+	d, _ := mp.Get("db")
+
+	tests := []struct {
+		name    string
+		id      *auth.Identity
+		rule    string
+		allowed bool
+	}{
+		{"group", &auth.Identity{Subject: "alice", Groups: []string{"dba"}}, "dba", true},
+		{"deny first", &auth.Identity{Subject: "bob", Groups: []string{"dba", "contractors"}}, "no-contractors", false},
+		{"all conditions", &auth.Identity{Subject: "carol", Email: "carol@EXAMPLE.com", Claims: map[string]interface{}{"roles": "admin"}}, "admins", true},
+		{"partial conditions", &auth.Identity{Subject: "dave", Email: "dave@example.com"}, RuleDefault, false},
+		{"subject", &auth.Identity{Subject: "robot"}, "#4", true},
+		{"no match", &auth.Identity{Subject: "eve", Email: "eve@example.net", Claims: map[string]interface{}{"roles": []interface{}{"admin"}}}, RuleDefault, false},
+	}
+	for _, tt := range tests {
+		rule, allowed := d.Authorize(tt.id)
+		assert.Equal(t, tt.rule, rule, tt.name)
+		assert.Equal(t, tt.allowed, allowed, tt.name)
+	}
+
+	d, _ = mp.Get("open")
+	_, allowed := d.Authorize(&auth.Identity{Subject: "anyone"})
+	assert.True(t, allowed)
+
+	writeMap(t, mapFile, "destinations:\n  - name: db\n    upstreams: [127.0.0.1:3306]\n    authorization:\n      - name: empty\n")
+	_, err = New(mapFile, zap.NewNop())
+	assert.ErrorContains(t, err, "rule empty has no condition")
+}
@@ -0,0 +1,58 @@
+package mapping
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// maxEjectionMultiplier caps the backoff of an upstream ejected repeatedly
+const maxEjectionMultiplier = 10
+
+// Ejected upstream is ejected by outlier detection
+func (u *Upstream) Ejected() bool {
+	until := atomic.LoadInt64(&u.state.ejectedUntil)
+	return until > 0 && time.Now().UnixNano() < until
+}
+
+// Available upstream is healthy and not ejected
+func (u *Upstream) Available() bool {
+	return u.Healthy() && !u.Ejected()
+}
+
+// ReportFailure count a failure seen in real traffic. After consecutiveFailures failures
+// in a row, the upstream is ejected for ejectionTime multiplied by the number of
+// ejections in a row. Returns the ejection period, or 0 if not ejected
+func (u *Upstream) ReportFailure(consecutiveFailures int, ejectionTime time.Duration) time.Duration {
+	if consecutiveFailures <= 0 {
+		return 0
+	}
+	st := u.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if u.Ejected() {
+		// sessions started before the ejection
+		return 0
+	}
+	st.passiveFailures++
+	if st.passiveFailures < consecutiveFailures {
+		return 0
+	}
+	st.passiveFailures = 0
+	if st.ejections < maxEjectionMultiplier {
+		st.ejections++
+	}
+	d := ejectionTime * time.Duration(st.ejections)
+	atomic.StoreInt64(&st.ejectedUntil, time.Now().Add(d).UnixNano())
+	return d
+}
+
+// ReportSuccess reset the failure count of the upstream
+func (u *Upstream) ReportSuccess() {
+	st := u.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.passiveFailures = 0
+	if !u.Ejected() {
+		st.ejections = 0
+	}
+}
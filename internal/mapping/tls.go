@@ -0,0 +1,67 @@
+package mapping
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfig settings of TLS connections to the upstreams of a destination
+type TLSConfig struct {
+	Enabled            bool   `yaml:"enabled" json:"enabled"`
+	ServerName         string `yaml:"server_name" json:"server_name"`
+	CAFile             string `yaml:"ca_file" json:"ca_file"`
+	CertFile           string `yaml:"cert_file" json:"cert_file"`
+	KeyFile            string `yaml:"key_file" json:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+}
+
+// build load the CA bundle and the client certificate
+func (c *TLSConfig) build() (*tls.Config, error) {
+	if c == nil || !c.Enabled {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if c.CAFile != "" {
+		b, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read ca_file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificate found in ca_file: %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("both cert_file and key_file are required for client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// TLSEnabled connections to the upstreams are TLS
+func (d *Destination) TLSEnabled() bool {
+	return d.tlsConfig != nil
+}
+
+// TLSConfig tls.Config to connect the upstreams, or nil if TLS is not enabled.
+// ServerName is empty unless configured, so the host of the upstream should be used
+func (d *Destination) TLSConfig() *tls.Config {
+	if d.tlsConfig == nil {
+		return nil
+	}
+	return d.tlsConfig.Clone()
+}
@@ -0,0 +1,177 @@
+package mapping
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Load balancing strategies
+const (
+	BalanceRoundRobin   = "round_robin"
+	BalanceRandom       = "random"
+	BalanceLeastConn    = "least_conn"
+	BalanceHashUser     = "hash_user"
+	BalanceHashClientIP = "hash_client_ip"
+)
+
+// SelectKey attributes of the request used to choose an upstream
+type SelectKey struct {
+	User     string
+	ClientIP string
+}
+
+// ErrNoHealthyUpstream every upstream of the destination is down or ejected
+var ErrNoHealthyUpstream = errors.New("no healthy upstream")
+
+// upstreamState runtime state of an upstream, kept across map reloads
+type upstreamState struct {
+	active       int64
+	down         int32
+	ejectedUntil int64
+
+	mu sync.Mutex
+	// health check results
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+	// outlier detection
+	passiveFailures int
+	ejections       int
+}
+
+// Upstream a member of the upstream pool of a destination
+type Upstream struct {
+	// Network "tcp" or "unix"
+	Network string
+	// Address host:port or path of the unix domain socket
+	Address string
+	state   *upstreamState
+}
+
+// String upstream for logging. unix domain sockets are prefixed with "unix:"
+func (u *Upstream) String() string {
+	if u.Network == "unix" {
+		return "unix:" + u.Address
+	}
+	return u.Address
+}
+
+// parseUpstream parse "host:port", "tcp://host:port", "unix:/path" or "unix:///path"
+func parseUpstream(s string) (*Upstream, error) {
+	switch {
+	case strings.HasPrefix(s, "unix://"):
+		return parseUnix(strings.TrimPrefix(s, "unix://"))
+	case strings.HasPrefix(s, "unix:"):
+		return parseUnix(strings.TrimPrefix(s, "unix:"))
+	case strings.HasPrefix(s, "tcp://"):
+		s = strings.TrimPrefix(s, "tcp://")
+	}
+	if err := validateHostPort(s); err != nil {
+		return nil, err
+	}
+	return &Upstream{Network: "tcp", Address: s}, nil
+}
+
+func parseUnix(path string) (*Upstream, error) {
+	if path == "" {
+		return nil, errors.New("empty unix domain socket path")
+	}
+	return &Upstream{Network: "unix", Address: path}, nil
+}
+
+// Acquire count up active sessions
+func (u *Upstream) Acquire() {
+	atomic.AddInt64(&u.state.active, 1)
+}
+
+// Release count down active sessions
+func (u *Upstream) Release() {
+	atomic.AddInt64(&u.state.active, -1)
+}
+
+// Active number of active sessions
+func (u *Upstream) Active() int64 {
+	return atomic.LoadInt64(&u.state.active)
+}
+
+func validateBalance(balance string) error {
+	switch balance {
+	case "", BalanceRoundRobin, BalanceRandom, BalanceLeastConn, BalanceHashUser, BalanceHashClientIP:
+		return nil
+	}
+	return errors.Errorf("unknown balance: %s", balance)
+}
+
+// Candidates available members of the pool ordered by the balance strategy, for failover
+func (d *Destination) Candidates(key SelectKey) []*Upstream {
+	pool := make([]*Upstream, 0, len(d.pool))
+	for _, u := range d.pool {
+		if u.Available() {
+			pool = append(pool, u)
+		}
+	}
+	n := len(pool)
+	if n == 0 {
+		return nil
+	}
+	c := make([]*Upstream, 0, n)
+	switch d.Balance {
+	case BalanceRandom:
+		start := rand.Intn(n)
+		for i := 0; i < n; i++ {
+			c = append(c, pool[(start+i)%n])
+		}
+	case BalanceLeastConn:
+		// rotate before sorting so ties are spread across the pool
+		start := int((atomic.AddUint64(d.rr, 1) - 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			c = append(c, pool[(start+i)%n])
+		}
+		sort.SliceStable(c, func(i, j int) bool {
+			return c[i].Active() < c[j].Active()
+		})
+	case BalanceHashUser:
+		c = rendezvous(pool, key.User)
+	case BalanceHashClientIP:
+		c = rendezvous(pool, key.ClientIP)
+	default:
+		start := int((atomic.AddUint64(d.rr, 1) - 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			c = append(c, pool[(start+i)%n])
+		}
+	}
+	return c
+}
+
+// rendezvous order the pool by highest random weight hashing. Only 1/n of keys
+// move to another upstream when a member is added or removed
+func rendezvous(pool []*Upstream, key string) []*Upstream {
+	type scored struct {
+		u     *Upstream
+		score uint64
+	}
+	s := make([]scored, len(pool))
+	for i, u := range pool {
+		h := fnv.New64a()
+		h.Write([]byte(u.String()))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		s[i] = scored{u, h.Sum64()}
+	}
+	sort.SliceStable(s, func(i, j int) bool {
+		return s[i].score > s[j].score
+	})
+	c := make([]*Upstream, len(s))
+	for i := range s {
+		c[i] = s[i].u
+	}
+	return c
+}
@@ -0,0 +1,126 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/pkg/errors"
+)
+
+// TLV types used by wsgate-server, in the custom range of PROXY protocol v2
+const (
+	// TLVUser authenticated user
+	TLVUser byte = 0xE0
+	// TLVDestination name of /proxy/{dest}
+	TLVDestination byte = 0xE1
+)
+
+// v2Signature first 12 bytes of PROXY protocol v2 header
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// TLV type-length-value of PROXY protocol v2
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header PROXY protocol header
+type Header struct {
+	// Version 1 or 2
+	Version int
+	// Source address of the client
+	Source *net.TCPAddr
+	// Destination address the client connected to
+	Destination *net.TCPAddr
+	// TLVs sent with v2 only
+	TLVs []TLV
+}
+
+// Format encode the header
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1(), nil
+	case 2:
+		return h.formatV2()
+	}
+	return nil, errors.Errorf("unknown PROXY protocol version: %d", h.Version)
+}
+
+// addrs source and destination IPs in the same family, or nil if unknown
+func (h *Header) addrs() (src, dst net.IP, v4 bool) {
+	if h.Source == nil || h.Destination == nil || h.Source.IP == nil || h.Destination.IP == nil {
+		return nil, nil, false
+	}
+	src4, dst4 := h.Source.IP.To4(), h.Destination.IP.To4()
+	if src4 != nil && dst4 != nil {
+		return src4, dst4, true
+	}
+	src, dst = h.Source.IP.To16(), h.Destination.IP.To16()
+	if src == nil || dst == nil {
+		return nil, nil, false
+	}
+	return src, dst, false
+}
+
+func (h *Header) formatV1() []byte {
+	src, dst, v4 := h.addrs()
+	if src == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP4"
+	srcStr, dstStr := src.String(), dst.String()
+	if !v4 {
+		// net.IP prints IPv4-mapped addresses as IPv4
+		proto = "TCP6"
+		srcStr = netip.AddrFrom16([16]byte(src)).String()
+		dstStr = netip.AddrFrom16([16]byte(dst)).String()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		proto, srcStr, dstStr, h.Source.Port, h.Destination.Port))
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	var body bytes.Buffer
+	// version 2, PROXY command
+	famProto := byte(0x00)
+	src, dst, v4 := h.addrs()
+	switch {
+	case src == nil:
+		// AF_UNSPEC, no address block
+	case v4:
+		famProto = 0x11
+		body.Write(src)
+		body.Write(dst)
+	default:
+		famProto = 0x21
+		body.Write(src)
+		body.Write(dst)
+	}
+	if src != nil {
+		binary.Write(&body, binary.BigEndian, uint16(h.Source.Port))
+		binary.Write(&body, binary.BigEndian, uint16(h.Destination.Port))
+	}
+	for _, tlv := range h.TLVs {
+		if len(tlv.Value) > 0xFFFF {
+			return nil, errors.Errorf("TLV 0x%02x is too long", tlv.Type)
+		}
+		body.WriteByte(tlv.Type)
+		binary.Write(&body, binary.BigEndian, uint16(len(tlv.Value)))
+		body.Write(tlv.Value)
+	}
+	if body.Len() > 0xFFFF {
+		return nil, errors.New("PROXY protocol header is too long")
+	}
+
+	var b bytes.Buffer
+	b.Write(v2Signature)
+	b.WriteByte(0x21)
+	b.WriteByte(famProto)
+	binary.Write(&b, binary.BigEndian, uint16(body.Len()))
+	b.Write(body.Bytes())
+	return b.Bytes(), nil
+}
@@ -0,0 +1,65 @@
+package proxyproto
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatV1(t *testing.T) {
+	h := &Header{
+		Version:     1,
+		Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+		Destination: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 8086},
+	}
+	b, err := h.Format()
+	assert.NoError(t, err)
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 192.0.2.10 56324 8086\r\n", string(b))
+
+	h.Source = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	b, err = h.Format()
+	assert.NoError(t, err)
+	assert.Equal(t, "PROXY TCP6 2001:db8::1 ::ffff:192.0.2.10 56324 8086\r\n", string(b))
+
+	h.Source = nil
+	b, err = h.Format()
+	assert.NoError(t, err)
+	assert.Equal(t, "PROXY UNKNOWN\r\n", string(b))
+}
+
+func TestFormatV2(t *testing.T) {
+	h := &Header{
+		Version:     2,
+		Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 0x1234},
+		Destination: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 0x1f96},
+		TLVs: []TLV{
+			{Type: TLVUser, Value: []byte("alice")},
+			{Type: TLVDestination, Value: []byte("db")},
+		},
+	}
+	b, err := h.Format()
+	assert.NoError(t, err)
+	assert.Equal(t, v2Signature, b[:12])
+	assert.Equal(t, []byte{0x21, 0x11, 0x00, 12 + 8 + 5}, b[12:16])
+	assert.Equal(t, []byte{192, 0, 2, 1, 192, 0, 2, 10, 0x12, 0x34, 0x1f, 0x96}, b[16:28])
+	assert.Equal(t, []byte{TLVUser, 0x00, 0x05, 'a', 'l', 'i', 'c', 'e'}, b[28:36])
+	assert.Equal(t, []byte{TLVDestination, 0x00, 0x02, 'd', 'b'}, b[36:])
+
+	h.Source = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 0x1234}
+	h.TLVs = nil
+	b, err = h.Format()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x21, 0x21, 0x00, 36}, b[12:16])
+	assert.Len(t, b, 16+36)
+
+	h.Source = nil
+	h.TLVs = []TLV{{Type: TLVUser, Value: []byte("bob")}}
+	b, err = h.Format()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x21, 0x00, 0x00, 6}, b[12:16])
+
+	h.Version = 3
+	_, err = h.Format()
+	assert.Error(t, err)
+}
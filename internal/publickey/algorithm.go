@@ -0,0 +1,62 @@
+package publickey
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+)
+
+// allAlgorithms algorithms of the supported key types
+var allAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// algorithmsForKey algorithms allowed for the type of key
+func algorithmsForKey(key interface{}) []string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return []string{"RS256", "RS384", "RS512"}
+	case *ecdsa.PublicKey:
+		switch k.Curve.Params().Name {
+		case "P-256":
+			return []string{"ES256"}
+		case "P-384":
+			return []string{"ES384"}
+		case "P-521":
+			return []string{"ES512"}
+		}
+	case ed25519.PublicKey:
+		return []string{"EdDSA"}
+	}
+	return nil
+}
+
+// readPublicKey read RSA, ECDSA or Ed25519 public key in PEM
+func readPublicKey(publicKeyFile string) (interface{}, error) {
+	b, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed read pubkey")
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(b); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(b); err == nil {
+		return key, nil
+	}
+	key, err := jwt.ParseEdPublicKeyFromPEM(b)
+	if err != nil {
+		return nil, errors.New("failed parse pubkey: not a RSA, ECDSA or Ed25519 public key")
+	}
+	return key, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
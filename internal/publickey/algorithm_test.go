@@ -0,0 +1,138 @@
+package publickey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func writePublicKey(t *testing.T, pub crypto.PublicKey) string {
+	t.Helper()
+	b, err := x509.MarshalPKIXPublicKey(pub)
+	assert.NoError(t, err)
+	f := filepath.Join(t.TempDir(), "pub.pem")
+	assert.NoError(t, os.WriteFile(f, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), 0o644))
+	return f
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key crypto.PrivateKey) string {
+	t.Helper()
+	now := time.Now()
+	s, err := jwt.NewWithClaims(method, jwt.RegisteredClaims{
+		Subject:   "test-subject",
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+	}).SignedString(key)
+	assert.NoError(t, err)
+	return "Bearer " + s
+}
+
+func TestECDSAAndEdDSA(t *testing.T) {
+	logger := zap.NewNop()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	pk, err := New(writePublicKey(t, &ecKey.PublicKey), time.Minute, logger)
+	assert.NoError(t, err)
+	claims, err := pk.Verify(sign(t, jwt.SigningMethodES256, ecKey))
+	assert.NoError(t, err)
+	assert.Equal(t, "test-subject", claims.Subject)
+	// the algorithm follows the curve
+	ec384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	_, err = pk.Verify(sign(t, jwt.SigningMethodES384, ec384))
+	assert.ErrorContains(t, err, "not allowed")
+
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	pk, err = New(writePublicKey(t, edPub), time.Minute, logger)
+	assert.NoError(t, err)
+	_, err = pk.Verify(sign(t, jwt.SigningMethodEdDSA, edKey))
+	assert.NoError(t, err)
+
+	rsaKey, _, err := generateTestKeys()
+	assert.NoError(t, err)
+	_, err = pk.Verify(sign(t, jwt.SigningMethodRS256, rsaKey))
+	assert.ErrorContains(t, err, "not allowed")
+}
+
+func TestAlgorithmAllowList(t *testing.T) {
+	logger := zap.NewNop()
+	rsaKey, rsaPEM, err := generateTestKeys()
+	assert.NoError(t, err)
+	f := filepath.Join(t.TempDir(), "pub.pem")
+	assert.NoError(t, os.WriteFile(f, rsaPEM, 0o644))
+
+	pk, err := New(f, time.Minute, logger, WithAlgorithms([]string{"RS512"}))
+	assert.NoError(t, err)
+	_, err = pk.Verify(sign(t, jwt.SigningMethodRS256, rsaKey))
+	assert.ErrorContains(t, err, "signing method RS256 is invalid")
+	_, err = pk.Verify(sign(t, jwt.SigningMethodRS512, rsaKey))
+	assert.NoError(t, err)
+
+	_, err = New(f, time.Minute, logger, WithAlgorithms([]string{"HS256"}))
+	assert.ErrorContains(t, err, "unsupported algorithm")
+}
+
+func TestJWKSKeyTypes(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	enc := base64.RawURLEncoding.EncodeToString
+	b, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "alg": "ES256",
+				"x": enc(ecKey.X.FillBytes(make([]byte, 32))), "y": enc(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": enc(edPub)},
+		},
+	})
+	assert.NoError(t, err)
+	f := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(f, b, 0o644))
+
+	pk, err := New("", time.Minute, zap.NewNop(), WithJWKS(f, time.Hour, time.Minute))
+	assert.NoError(t, err)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+		Subject:   "ec-subject",
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	})
+	token.Header["kid"] = "ec"
+	s, err := token.SignedString(ecKey)
+	assert.NoError(t, err)
+	claims, err := pk.Verify("Bearer " + s)
+	assert.NoError(t, err)
+	assert.Equal(t, "ec-subject", claims.Subject)
+
+	token = jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.RegisteredClaims{
+		Subject:   "ed-subject",
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	})
+	token.Header["kid"] = "ed"
+	s, err = token.SignedString(edKey)
+	assert.NoError(t, err)
+	claims, err = pk.Verify("Bearer " + s)
+	assert.NoError(t, err)
+	assert.Equal(t, "ed-subject", claims.Subject)
+
+	_, err = parseJWKS([]byte(`{"keys":[{"kty":"EC","kid":"bad","crv":"P-256","x":"AQ","y":"AQ"}]}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,118 @@
+package publickey
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+)
+
+// claim matcher operators
+const (
+	opEqual    = "=="
+	opNotEqual = "!="
+	opContains = "contains"
+)
+
+// ClaimMatcher requirement on a claim, such as `groups contains "dba"` or `email_verified == true`
+type ClaimMatcher struct {
+	// Claim name. Nested claims are separated by "."
+	Claim string
+	Op    string
+	// Value JSON value to compare. A value that is not valid JSON is a string
+	Value interface{}
+	expr  string
+}
+
+var claimMatcherRe = regexp.MustCompile(`^\s*(\S+)\s+(\S+)\s+(.+?)\s*$`)
+
+// ParseClaimMatcher parse "<claim> <op> <value>". op is ==, != or contains
+func ParseClaimMatcher(expr string) (*ClaimMatcher, error) {
+	f := claimMatcherRe.FindStringSubmatch(expr)
+	if f == nil {
+		return nil, errors.Errorf("invalid claim requirement: %q", expr)
+	}
+	claim, op, raw := f[1], f[2], f[3]
+	if op != opEqual && op != opNotEqual && op != opContains {
+		return nil, errors.Errorf("unknown operator %q in claim requirement: %q", op, expr)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		v = raw
+	}
+	return &ClaimMatcher{
+		Claim: claim,
+		Op:    op,
+		Value: v,
+		expr:  fmt.Sprintf("%s %s %s", claim, op, raw),
+	}, nil
+}
+
+// String expression of the matcher
+func (m *ClaimMatcher) String() string {
+	return m.expr
+}
+
+// Match check the claims
+func (m *ClaimMatcher) Match(claims jwt.MapClaims) error {
+	v, ok := lookupClaim(claims, m.Claim)
+	switch m.Op {
+	case opEqual:
+		if !ok || !reflect.DeepEqual(v, m.Value) {
+			return errors.Errorf("claim requirement `%s` failed", m)
+		}
+	case opNotEqual:
+		if ok && reflect.DeepEqual(v, m.Value) {
+			return errors.Errorf("claim requirement `%s` failed", m)
+		}
+	case opContains:
+		if !ok || !containsValue(v, m.Value) {
+			return errors.Errorf("claim requirement `%s` failed", m)
+		}
+	}
+	return nil
+}
+
+// lookupClaim claim by name. "a.b" is claim b in object a
+func lookupClaim(claims jwt.MapClaims, name string) (interface{}, bool) {
+	var v interface{} = map[string]interface{}(claims)
+	for _, key := range strings.Split(name, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok = obj[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// containsValue v is an array with an element equal to want, or a space
+// separated string (like scope) with a word equal to want
+func containsValue(v, want interface{}) bool {
+	switch vv := v.(type) {
+	case []interface{}:
+		for _, e := range vv {
+			if reflect.DeepEqual(e, want) {
+				return true
+			}
+		}
+	case string:
+		w, ok := want.(string)
+		if !ok {
+			return false
+		}
+		for _, e := range strings.Fields(vv) {
+			if e == w {
+				return true
+			}
+		}
+	}
+	return false
+}
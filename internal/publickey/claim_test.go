@@ -0,0 +1,107 @@
+package publickey
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestClaimMatcher(t *testing.T) {
+	claims := jwt.MapClaims{
+		"groups":         []interface{}{"dba", "dev"},
+		"email_verified": true,
+		"hd":             "example.com",
+		"scope":          "read write",
+		"level":          float64(3),
+		"realm_access":   map[string]interface{}{"roles": []interface{}{"admin"}},
+	}
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{`groups contains "dba"`, true},
+		{`groups contains dba`, true},
+		{`groups contains "ops"`, false},
+		{`email_verified == true`, true},
+		{`email_verified == false`, false},
+		{`hd == "example.com"`, true},
+		{`hd != "example.com"`, false},
+		{`missing != "x"`, true},
+		{`missing == "x"`, false},
+		{`scope contains write`, true},
+		{`level == 3`, true},
+		{`realm_access.roles contains admin`, true},
+	}
+	for _, tt := range tests {
+		m, err := ParseClaimMatcher(tt.expr)
+		assert.NoError(t, err, tt.expr)
+		err = m.Match(claims)
+		if tt.ok {
+			assert.NoError(t, err, tt.expr)
+		} else {
+			assert.ErrorContains(t, err, "claim requirement", tt.expr)
+		}
+	}
+
+	for _, expr := range []string{"groups", "groups contains", "groups =~ dba"} {
+		_, err := ParseClaimMatcher(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	privateKey, publicKeyPEM, err := generateTestKeys()
+	assert.NoError(t, err)
+	f := filepath.Join(t.TempDir(), "pub.pem")
+	assert.NoError(t, os.WriteFile(f, publicKeyPEM, 0o644))
+
+	pk, err := New(f, time.Minute, zap.NewNop(),
+		WithIssuer([]string{"https://idp.example.com"}),
+		WithAudience([]string{"wsgate"}),
+		WithLeeway(30*time.Second),
+		WithRequiredClaims([]string{`groups contains "dba"`, "email_verified == true"}),
+	)
+	assert.NoError(t, err)
+
+	sign := func(mod func(jwt.MapClaims)) string {
+		now := time.Now()
+		claims := jwt.MapClaims{
+			"sub":            "test-subject",
+			"iss":            "https://idp.example.com",
+			"aud":            []string{"other", "wsgate"},
+			"iat":            now.Unix(),
+			"exp":            now.Add(time.Minute).Unix(),
+			"groups":         []string{"dba"},
+			"email_verified": true,
+		}
+		mod(claims)
+		s, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(privateKey)
+		assert.NoError(t, err)
+		return "Bearer " + s
+	}
+
+	claims, err := pk.Verify(sign(func(c jwt.MapClaims) {}))
+	assert.NoError(t, err)
+	assert.Equal(t, "test-subject", claims.Subject)
+
+	// expired within leeway
+	_, err = pk.Verify(sign(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-10 * time.Second).Unix() }))
+	assert.NoError(t, err)
+
+	_, err = pk.Verify(sign(func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }))
+	assert.ErrorContains(t, err, "issuer check failed")
+
+	_, err = pk.Verify(sign(func(c jwt.MapClaims) { c["aud"] = "other" }))
+	assert.ErrorContains(t, err, "audience check failed")
+
+	_, err = pk.Verify(sign(func(c jwt.MapClaims) { c["groups"] = []string{"dev"} }))
+	assert.ErrorContains(t, err, "claim requirement `groups contains \"dba\"` failed")
+
+	_, err = pk.Verify(sign(func(c jwt.MapClaims) { delete(c, "email_verified") }))
+	assert.ErrorContains(t, err, "claim requirement `email_verified == true` failed")
+}
@@ -0,0 +1,38 @@
+package publickey
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Google Cloud Identity-Aware Proxy signed header
+const (
+	// IAPHeader header with the signed assertion of IAP
+	IAPHeader = "X-Goog-IAP-JWT-Assertion"
+	// IAPIssuer iss of assertions
+	IAPIssuer = "https://cloud.google.com/iap"
+	// IAPJWKS keys of IAP
+	IAPJWKS = "https://www.gstatic.com/iap/verify/public_key-jwk"
+	// IAPAlgorithm alg of assertions
+	IAPAlgorithm = "ES256"
+)
+
+// NewIAP verifier of IAP signed headers. audiences are the expected aud, like
+// "/projects/PROJECT_NUMBER/global/backendServices/SERVICE_ID". Keys are fetched
+// from IAPJWKS unless opts has WithJWKS. The algorithm, issuer and audience
+// can not be overridden by opts
+func NewIAP(audiences []string, freshnessTime time.Duration, logger *zap.Logger, opts ...Option) (*Publickey, error) {
+	if len(audiences) == 0 {
+		return nil, errors.New("audience is required for IAP")
+	}
+	o := []Option{WithJWKS(IAPJWKS, time.Hour, time.Minute)}
+	o = append(o, opts...)
+	o = append(o,
+		WithAlgorithms([]string{IAPAlgorithm}),
+		WithIssuer([]string{IAPIssuer}),
+		WithAudience(audiences),
+	)
+	return New("", freshnessTime, logger, o...)
+}
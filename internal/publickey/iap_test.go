@@ -0,0 +1,69 @@
+package publickey
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const testIAPAudience = "/projects/1234/global/backendServices/5678"
+
+func TestIAP(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	enc := base64.RawURLEncoding.EncodeToString
+	b, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "EC", "kid": "iap", "crv": "P-256", "alg": "ES256", "use": "sig",
+				"x": enc(key.X.FillBytes(make([]byte, 32))), "y": enc(key.Y.FillBytes(make([]byte, 32)))},
+		},
+	})
+	assert.NoError(t, err)
+	f := filepath.Join(t.TempDir(), "iap.json")
+	assert.NoError(t, os.WriteFile(f, b, 0o644))
+
+	_, err = NewIAP(nil, time.Minute, zap.NewNop(), WithJWKS(f, time.Hour, time.Minute))
+	assert.ErrorContains(t, err, "audience is required")
+
+	// WithAlgorithms in opts does not override ES256
+	pk, err := NewIAP([]string{testIAPAudience}, time.Minute, zap.NewNop(),
+		WithJWKS(f, time.Hour, time.Minute), WithAlgorithms([]string{"RS256"}))
+	assert.NoError(t, err)
+
+	assertion := func(iss, aud string) string {
+		now := time.Now()
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"iss":   iss,
+			"aud":   aud,
+			"sub":   "accounts.google.com:1234567890",
+			"email": "alice@example.com",
+			"iat":   now.Unix(),
+			"exp":   now.Add(10 * time.Minute).Unix(),
+		})
+		token.Header["kid"] = "iap"
+		s, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return s
+	}
+
+	claims, err := pk.Verify(assertion(IAPIssuer, testIAPAudience))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", claims.Raw["email"])
+
+	_, err = pk.Verify(assertion("https://accounts.google.com", testIAPAudience))
+	assert.ErrorContains(t, err, "issuer check failed")
+	_, err = pk.Verify(assertion(IAPIssuer, "/projects/1234/apps/other"))
+	assert.ErrorContains(t, err, "audience check failed")
+	_, err = pk.Verify("")
+	assert.Error(t, err)
+}
@@ -0,0 +1,290 @@
+package publickey
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// maxJWKSSize limits the size of a JWKS document
+const maxJWKSSize = 1 << 20
+
+// jwk a key in JWKS document
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	X string `json:"x"`
+	Y string `json:"y"`
+}
+
+// jwkKey public key in JWKS with the alg it is restricted to
+type jwkKey struct {
+	key interface{}
+	alg string
+}
+
+type jwksDocument struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwks keys loaded from a local file or an HTTP URL, selected by kid
+type jwks struct {
+	source          string
+	refreshInterval time.Duration
+	minRefresh      time.Duration
+	client          *http.Client
+	logger          *zap.Logger
+
+	mu          sync.Mutex
+	keys        map[string]jwkKey
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	// fetching closed when the running fetch ends. nil if none
+	fetching chan struct{}
+}
+
+func newJWKS(source string, refreshInterval, minRefresh time.Duration, logger *zap.Logger) (*jwks, error) {
+	j := &jwks{
+		source:          source,
+		refreshInterval: refreshInterval,
+		minRefresh:      minRefresh,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		logger:          logger,
+	}
+	keys, err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	j.keys = keys
+	j.fetchedAt = time.Now()
+	j.lastAttempt = j.fetchedAt
+	j.logger.Info("Loaded jwks", zap.String("jwks", j.source), zap.Int("keys", len(keys)))
+	return j, nil
+}
+
+func (j *jwks) isURL() bool {
+	return strings.HasPrefix(j.source, "http://") || strings.HasPrefix(j.source, "https://")
+}
+
+func (j *jwks) read() ([]byte, error) {
+	if !j.isURL() {
+		return os.ReadFile(j.source)
+	}
+	res, err := j.client.Get(j.source)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, maxJWKSSize))
+}
+
+// load fetch and parse the document
+func (j *jwks) load() (map[string]jwkKey, error) {
+	b, err := j.read()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed read jwks")
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed parse jwks")
+	}
+	return keys, nil
+}
+
+// refresh refetch the document if due() and the last attempt is older than minRefresh.
+// The fetch runs without j.mu, so verifications with the current keys are not blocked by a
+// slow endpoint. While another goroutine is fetching, refresh waits for it only if wait
+func (j *jwks) refresh(due func() bool, wait bool) {
+	j.mu.Lock()
+	if done := j.fetching; done != nil {
+		j.mu.Unlock()
+		if wait {
+			<-done
+		}
+		return
+	}
+	if time.Since(j.lastAttempt) <= j.minRefresh || !due() {
+		j.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	j.fetching = done
+	j.lastAttempt = time.Now()
+	j.mu.Unlock()
+
+	keys, err := j.load()
+
+	j.mu.Lock()
+	if err == nil {
+		j.keys = keys
+		j.fetchedAt = time.Now()
+	}
+	j.fetching = nil
+	j.mu.Unlock()
+	close(done)
+
+	if err != nil {
+		j.logger.Warn("Failed to refresh jwks. Keep current keys", zap.String("jwks", j.source), zap.Error(err))
+		return
+	}
+	j.logger.Info("Loaded jwks", zap.String("jwks", j.source), zap.Int("keys", len(keys)))
+}
+
+// stale the document is older than refreshInterval. j.mu must be held
+func (j *jwks) stale() bool {
+	return j.refreshInterval > 0 && time.Since(j.fetchedAt) > j.refreshInterval
+}
+
+// get key by kid. The document is refetched when it is older than refreshInterval,
+// or when kid is unknown and the last fetch is older than minRefresh
+func (j *jwks) get(kid string) (jwkKey, error) {
+	j.refresh(j.stale, false)
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	j.refresh(func() bool { return true }, true)
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	return jwkKey{}, fmt.Errorf("unknown kid: %q", kid)
+}
+
+// lookup a token without kid is accepted only if the set has one key
+func (j *jwks) lookup(kid string) (jwkKey, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if kid == "" {
+		if len(j.keys) != 1 {
+			return jwkKey{}, false
+		}
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+func parseJWKS(b []byte) (map[string]jwkKey, error) {
+	var doc jwksDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]jwkKey)
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "key #%d", i+1)
+		}
+		if key == nil {
+			// unsupported key type
+			continue
+		}
+		if _, ok := keys[k.Kid]; ok {
+			return nil, fmt.Errorf("duplicated kid: %q", k.Kid)
+		}
+		if k.Alg != "" && !contains(algorithmsForKey(key), k.Alg) {
+			return nil, fmt.Errorf("key #%d: alg %s does not match kty %s", i+1, k.Alg, k.Kty)
+		}
+		keys[k.Kid] = jwkKey{key: key, alg: k.Alg}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable key")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid n")
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid e")
+		}
+		if !e.IsInt64() || e.Int64() < 2 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid e")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported crv: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid x")
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid y")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		// ECDH rejects points not on the curve
+		if _, err := key.ECDH(); err != nil {
+			return nil, errors.Wrapf(err, "invalid point of %s", k.Crv)
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported crv: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.X, "="))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid x")
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size: %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty value")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,177 @@
+package publickey
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func signWithKid(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	t.Helper()
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.RegisteredClaims{
+		Subject:   "test-subject",
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return s
+}
+
+type jwksServer struct {
+	mu       sync.Mutex
+	keys     []map[string]string
+	requests int32
+}
+
+func (s *jwksServer) set(keys ...map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&s.requests, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+}
+
+func TestJWKSRotation(t *testing.T) {
+	key1, _, err := generateTestKeys()
+	assert.NoError(t, err)
+	key2, _, err := generateTestKeys()
+	assert.NoError(t, err)
+
+	js := &jwksServer{}
+	js.set(rsaJWK("key1", &key1.PublicKey))
+	ts := httptest.NewServer(js)
+	defer ts.Close()
+
+	pk, err := New("", time.Minute, zap.NewNop(), WithJWKS(ts.URL, time.Hour, 0))
+	assert.NoError(t, err)
+	assert.True(t, pk.Enabled())
+
+	claims, err := pk.Verify("Bearer " + signWithKid(t, "key1", key1))
+	assert.NoError(t, err)
+	assert.Equal(t, "test-subject", claims.Subject)
+	// the only key is used for a token without kid
+	_, err = pk.Verify("Bearer " + signWithKid(t, "", key1))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&js.requests))
+
+	// rotate. unknown kid triggers a refetch
+	js.set(rsaJWK("key1", &key1.PublicKey), rsaJWK("key2", &key2.PublicKey))
+	_, err = pk.Verify("Bearer " + signWithKid(t, "key2", key2))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&js.requests))
+
+	// key2 with wrong signature
+	_, err = pk.Verify("Bearer " + signWithKid(t, "key2", key1))
+	assert.ErrorContains(t, err, "token is invalid")
+}
+
+func TestJWKSRateLimit(t *testing.T) {
+	key1, _, err := generateTestKeys()
+	assert.NoError(t, err)
+
+	js := &jwksServer{}
+	js.set(rsaJWK("key1", &key1.PublicKey))
+	ts := httptest.NewServer(js)
+	defer ts.Close()
+
+	pk, err := New("", time.Minute, zap.NewNop(), WithJWKS(ts.URL, time.Hour, time.Hour))
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = pk.Verify("Bearer " + signWithKid(t, "unknown", key1))
+		assert.ErrorContains(t, err, "unknown kid")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&js.requests))
+}
+
+func TestJWKSSlowRefresh(t *testing.T) {
+	key1, _, err := generateTestKeys()
+	assert.NoError(t, err)
+
+	js := &jwksServer{}
+	js.set(rsaJWK("key1", &key1.PublicKey))
+	release := make(chan struct{})
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			<-release
+		}
+		js.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	pk, err := New("", time.Minute, zap.NewNop(), WithJWKS(ts.URL, time.Millisecond, 0))
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	// the refresh of the stale document hangs
+	go pk.Verify("Bearer " + signWithKid(t, "key1", key1))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&requests) == 2
+	}, time.Second, time.Millisecond)
+
+	// verification with a current key does not wait for it
+	start := time.Now()
+	_, err = pk.Verify("Bearer " + signWithKid(t, "key1", key1))
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestJWKSFile(t *testing.T) {
+	key1, _, err := generateTestKeys()
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			rsaJWK("key1", &key1.PublicKey),
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		},
+	})
+	assert.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(jwksFile, b, 0o644))
+
+	pk, err := New("", time.Minute, zap.NewNop(), WithJWKS(jwksFile, time.Hour, time.Minute))
+	assert.NoError(t, err)
+	_, err = pk.Verify("Bearer " + signWithKid(t, "key1", key1))
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(jwksFile, []byte(`{"keys":[]}`), 0o644))
+	_, err = New("", time.Minute, zap.NewNop(), WithJWKS(jwksFile, time.Hour, time.Minute))
+	assert.ErrorContains(t, err, "no usable key")
+}
@@ -1,13 +1,12 @@
 package publickey
 
 import (
-	"crypto/rsa"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/kazeburo/wsgate-server/internal/auth"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
@@ -15,60 +14,283 @@ import (
 // Publickey struct
 type Publickey struct {
 	publicKeyFile string
-	verifyKey     *rsa.PublicKey
+	verifyKey     interface{}
 	freshnessTime time.Duration
+	algorithms    []string
+	issuers       []string
+	audiences     []string
+	leeway        time.Duration
+	claimExprs    []string
+	claims        []*ClaimMatcher
+	replay        ReplayCache
+	revocation    *Revocation
+
+	jwksSource     string
+	jwksRefresh    time.Duration
+	jwksMinRefresh time.Duration
+	jwks           *jwks
+}
+
+// Claims verified claims of a token
+type Claims struct {
+	Subject   string
+	Issuer    string
+	ID        string
+	ExpiresAt time.Time
+	IssuedAt  time.Time
+	// Raw all claims in the token
+	Raw map[string]interface{}
+}
+
+// AuthMethod name of the authentication method of identities from tokens
+const AuthMethod = "jwt"
+
+// Identity identity of the token. Email and Groups are taken from "email" and "groups" claims
+func (c *Claims) Identity() *auth.Identity {
+	email, _ := c.Raw["email"].(string)
+	return &auth.Identity{
+		Method:    AuthMethod,
+		Subject:   c.Subject,
+		Email:     email,
+		Groups:    auth.ClaimStrings(c.Raw, "groups"),
+		Claims:    c.Raw,
+		ID:        c.ID,
+		IssuedAt:  c.IssuedAt,
+		ExpiresAt: c.ExpiresAt,
+	}
+}
+
+// Option optional settings of Publickey
+type Option func(*Publickey)
+
+// WithJWKS verify tokens with keys in a JWKS document of a local file or an HTTP URL.
+// The document is refetched every refresh, and when a token has an unknown kid
+// but not more often than minRefresh
+func WithJWKS(source string, refresh, minRefresh time.Duration) Option {
+	return func(pk *Publickey) {
+		pk.jwksSource = source
+		pk.jwksRefresh = refresh
+		pk.jwksMinRefresh = minRefresh
+	}
+}
+
+// WithAlgorithms allow only these algorithms, instead of the ones of the key types
+func WithAlgorithms(algorithms []string) Option {
+	return func(pk *Publickey) {
+		pk.algorithms = algorithms
+	}
+}
+
+// WithIssuer require iss to be one of issuers
+func WithIssuer(issuers []string) Option {
+	return func(pk *Publickey) {
+		pk.issuers = issuers
+	}
+}
+
+// WithAudience require aud to contain one of audiences
+func WithAudience(audiences []string) Option {
+	return func(pk *Publickey) {
+		pk.audiences = audiences
+	}
+}
+
+// WithLeeway allow clock skew when checking exp, nbf and iat
+func WithLeeway(leeway time.Duration) Option {
+	return func(pk *Publickey) {
+		pk.leeway = leeway
+	}
+}
+
+// WithRequiredClaims require claims to match all expressions. See ParseClaimMatcher
+func WithRequiredClaims(exprs []string) Option {
+	return func(pk *Publickey) {
+		pk.claimExprs = exprs
+	}
 }
 
 // New publickey reader/checker
-func New(publicKeyFile string, freshnessTime time.Duration, logger *zap.Logger) (*Publickey, error) {
-	var verifyKey *rsa.PublicKey
+func New(publicKeyFile string, freshnessTime time.Duration, logger *zap.Logger, opts ...Option) (*Publickey, error) {
+	var verifyKey interface{}
 	if publicKeyFile != "" {
-		verifyBytes, err := os.ReadFile(publicKeyFile)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed read pubkey")
-		}
-		verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(verifyBytes)
+		var err error
+		verifyKey, err = readPublicKey(publicKeyFile)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed parse pubkey")
+			return nil, err
 		}
 	}
-	return &Publickey{
+	pk := &Publickey{
 		publicKeyFile: publicKeyFile,
 		verifyKey:     verifyKey,
 		freshnessTime: freshnessTime,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(pk)
+	}
+	for _, alg := range pk.algorithms {
+		if !contains(allAlgorithms, alg) {
+			return nil, errors.Errorf("unsupported algorithm: %s", alg)
+		}
+	}
+	for _, expr := range pk.claimExprs {
+		m, err := ParseClaimMatcher(expr)
+		if err != nil {
+			return nil, err
+		}
+		pk.claims = append(pk.claims, m)
+	}
+	if pk.jwksSource != "" {
+		j, err := newJWKS(pk.jwksSource, pk.jwksRefresh, pk.jwksMinRefresh, logger)
+		if err != nil {
+			return nil, err
+		}
+		pk.jwks = j
+	}
+	return pk, nil
+}
+
+// Leeway allowed clock skew. Tokens are accepted until exp plus leeway
+func (pk *Publickey) Leeway() time.Duration {
+	return pk.leeway
 }
 
 // Enabled publickey is enabled
-func (pk Publickey) Enabled() bool {
-	return pk.publicKeyFile != ""
+func (pk *Publickey) Enabled() bool {
+	return pk.publicKeyFile != "" || pk.jwksSource != ""
+}
+
+// keyFunc key to verify the token. Keys in JWKS are selected by kid,
+// and the key of publicKeyFile is used for tokens not found in JWKS.
+// The alg of the token must match the key type
+func (pk *Publickey) keyFunc(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if pk.jwks != nil {
+		kid, _ := token.Header["kid"].(string)
+		jk, err := pk.jwks.get(kid)
+		if err == nil {
+			if jk.alg != "" && jk.alg != alg {
+				return nil, fmt.Errorf("alg %s is not allowed for kid %q", alg, kid)
+			}
+			return checkAlg(jk.key, alg)
+		}
+		if pk.verifyKey == nil {
+			return nil, err
+		}
+	}
+	return checkAlg(pk.verifyKey, alg)
+}
+
+func checkAlg(key interface{}, alg string) (interface{}, error) {
+	if !contains(algorithmsForKey(key), alg) {
+		return nil, fmt.Errorf("alg %s is not allowed for the key", alg)
+	}
+	return key, nil
+}
+
+// validMethods explicit allow-list or algorithms of all key types
+func (pk *Publickey) validMethods() []string {
+	if len(pk.algorithms) > 0 {
+		return pk.algorithms
+	}
+	return allAlgorithms
 }
 
 // Verify verify auth header
-func (pk Publickey) Verify(t string) (string, error) {
+func (pk *Publickey) Verify(t string) (*Claims, error) {
 	if t == "" {
-		return "", fmt.Errorf("no tokenString")
+		return nil, fmt.Errorf("no tokenString")
 	}
 	t = strings.TrimPrefix(t, "Bearer ")
 
-	claims := &jwt.RegisteredClaims{}
-	_, err := jwt.ParseWithClaims(t, claims, func(token *jwt.Token) (interface{}, error) {
-		return pk.verifyKey, nil
-	}, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"}))
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(t, claims, pk.keyFunc,
+		jwt.WithValidMethods(pk.validMethods()),
+		jwt.WithLeeway(pk.leeway),
+	)
 
 	if err != nil {
-		return "", fmt.Errorf("token is invalid: %v", err)
+		return nil, fmt.Errorf("token is invalid: %v", err)
 	}
 
 	now := time.Now()
-	iat := now.Add(-pk.freshnessTime)
+	iat := now.Add(-pk.freshnessTime - pk.leeway)
+
+	exp, _ := claims.GetExpirationTime()
+	if exp == nil || exp.Time.Add(pk.leeway).Before(now) {
+		return nil, fmt.Errorf("token is expired")
+	}
+	issuedAt, _ := claims.GetIssuedAt()
+	if issuedAt == nil || issuedAt.Time.Before(iat) {
+		return nil, fmt.Errorf("token is too old")
+	}
 
-	if claims.ExpiresAt == nil || claims.ExpiresAt.Time.Before(now) {
-		return "", fmt.Errorf("token is expired")
+	if len(pk.issuers) > 0 {
+		iss, _ := claims.GetIssuer()
+		if !contains(pk.issuers, iss) {
+			return nil, fmt.Errorf("issuer check failed: %q is not allowed", iss)
+		}
+	}
+	if len(pk.audiences) > 0 {
+		aud, _ := claims.GetAudience()
+		found := false
+		for _, a := range aud {
+			if contains(pk.audiences, a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("audience check failed: %q is not allowed", []string(aud))
+		}
+	}
+	for _, m := range pk.claims {
+		if err := m.Match(claims); err != nil {
+			return nil, err
+		}
+	}
+
+	sub, _ := claims.GetSubject()
+	iss, _ := claims.GetIssuer()
+	jti, _ := claims["jti"].(string)
+	c := &Claims{
+		Subject:   sub,
+		Issuer:    iss,
+		ID:        jti,
+		ExpiresAt: exp.Time,
+		IssuedAt:  issuedAt.Time,
+		Raw:       claims,
+	}
+	if pk.revocation != nil {
+		if err := pk.revocation.Check(c); err != nil {
+			return nil, err
+		}
 	}
-	if claims.IssuedAt == nil || claims.IssuedAt.Time.Before(iat) {
-		return "", fmt.Errorf("token is too old")
+	if pk.replay != nil {
+		if jti == "" {
+			return nil, fmt.Errorf("jti is required")
+		}
+		if err := pk.replay.Add(jti, exp.Time.Add(pk.leeway)); err != nil {
+			return nil, fmt.Errorf("%v: jti %q", err, jti)
+		}
 	}
+	return c, nil
+}
 
-	return claims.Subject, nil
+// AuthenticateToken verify the token and returns its identity. The handler takes the
+// token from the request, see handler.tokenAuthenticator
+func (pk *Publickey) AuthenticateToken(token string) (*auth.Identity, error) {
+	claims, err := pk.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return claims.Identity(), nil
+}
+
+// Revoked returns an error if the token of id is revoked. Identities of other methods are
+// never revoked by the list. Implements auth.Revoker
+func (pk *Publickey) Revoked(id *auth.Identity) error {
+	if pk.revocation == nil || id.Method != AuthMethod {
+		return nil
+	}
+	return pk.revocation.Check(&Claims{Subject: id.Subject, ID: id.ID, IssuedAt: id.IssuedAt})
 }
@@ -74,9 +74,9 @@ func TestVerify(t *testing.T) {
 	tokenString, err := token.SignedString(privateKey)
 	assert.NoError(t, err)
 
-	subject, err := pk.Verify("Bearer " + tokenString)
+	claims, err := pk.Verify("Bearer " + tokenString)
 	assert.NoError(t, err)
-	assert.Equal(t, "test-subject", subject)
+	assert.Equal(t, "test-subject", claims.Subject)
 
 	// Test expired token
 	expiredToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.RegisteredClaims{
@@ -134,3 +134,32 @@ func TestEnabled(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, pk.Enabled())
 }
+
+func TestAuthenticateToken(t *testing.T) {
+	privateKey, _, err := generateTestKeys()
+	assert.NoError(t, err)
+	pk, err := New(writePublicKey(t, &privateKey.PublicKey), time.Minute, zap.NewNop())
+	assert.NoError(t, err)
+
+	s, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":    "alice",
+		"jti":    "id-1",
+		"email":  "alice@example.com",
+		"groups": []string{"dba", "dev"},
+		"iat":    time.Now().Unix(),
+		"exp":    time.Now().Add(time.Minute).Unix(),
+	}).SignedString(privateKey)
+	assert.NoError(t, err)
+
+	id, err := pk.AuthenticateToken("Bearer " + s)
+	assert.NoError(t, err)
+	assert.Equal(t, AuthMethod, id.Method)
+	assert.Equal(t, "alice", id.Subject)
+	assert.Equal(t, "alice@example.com", id.Email)
+	assert.Equal(t, []string{"dba", "dev"}, id.Groups)
+	assert.Equal(t, "id-1", id.ID)
+	assert.False(t, id.ExpiresAt.IsZero())
+
+	_, err = pk.AuthenticateToken("Bearer invalid")
+	assert.ErrorContains(t, err, "token is invalid")
+}
@@ -0,0 +1,96 @@
+package publickey
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrReplayed the token ID is already used
+	ErrReplayed = errors.New("token is already used")
+	// ErrReplayCacheFull no room to remember the token ID
+	ErrReplayCacheFull = errors.New("replay cache is full")
+)
+
+// ReplayCache remembers IDs of used tokens. Implementations must be safe for concurrent use
+type ReplayCache interface {
+	// Add remember id until exp. Returns ErrReplayed if id is already remembered
+	Add(id string, exp time.Time) error
+}
+
+// WithReplayCache allow each token to be used only once. Tokens must have jti,
+// which is remembered in cache until the token expires
+func WithReplayCache(cache ReplayCache) Option {
+	return func(pk *Publickey) {
+		pk.replay = cache
+	}
+}
+
+type replayEntry struct {
+	id  string
+	exp time.Time
+}
+
+type replayHeap []replayEntry
+
+func (h replayHeap) Len() int            { return len(h) }
+func (h replayHeap) Less(i, j int) bool  { return h[i].exp.Before(h[j].exp) }
+func (h replayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x interface{}) { *h = append(*h, x.(replayEntry)) }
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+// MemoryReplayCache in-memory ReplayCache of a bounded size
+type MemoryReplayCache struct {
+	size int
+	mu   sync.Mutex
+	ids  map[string]struct{}
+	exps replayHeap
+	now  func() time.Time
+}
+
+// NewMemoryReplayCache in-memory ReplayCache remembering up to size IDs.
+// When it is full of unexpired IDs, new tokens are rejected with ErrReplayCacheFull
+// rather than forgetting IDs that could be replayed
+func NewMemoryReplayCache(size int) *MemoryReplayCache {
+	return &MemoryReplayCache{
+		size: size,
+		ids:  make(map[string]struct{}),
+		now:  time.Now,
+	}
+}
+
+// Add remember id until exp
+func (c *MemoryReplayCache) Add(id string, exp time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for len(c.exps) > 0 && !c.exps[0].exp.After(now) {
+		e := heap.Pop(&c.exps).(replayEntry)
+		delete(c.ids, e.id)
+	}
+	if _, ok := c.ids[id]; ok {
+		return ErrReplayed
+	}
+	if len(c.ids) >= c.size {
+		return ErrReplayCacheFull
+	}
+	c.ids[id] = struct{}{}
+	heap.Push(&c.exps, replayEntry{id: id, exp: exp})
+	return nil
+}
+
+// Len number of remembered IDs
+func (c *MemoryReplayCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.ids)
+}
@@ -0,0 +1,65 @@
+package publickey
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestMemoryReplayCache(t *testing.T) {
+	now := time.Now()
+	c := NewMemoryReplayCache(2)
+	c.now = func() time.Time { return now }
+
+	assert.NoError(t, c.Add("a", now.Add(time.Minute)))
+	assert.ErrorIs(t, c.Add("a", now.Add(time.Minute)), ErrReplayed)
+	assert.NoError(t, c.Add("b", now.Add(2*time.Minute)))
+	assert.ErrorIs(t, c.Add("c", now.Add(time.Minute)), ErrReplayCacheFull)
+
+	// a expires
+	now = now.Add(time.Minute)
+	assert.NoError(t, c.Add("c", now.Add(time.Minute)))
+	assert.ErrorIs(t, c.Add("b", now.Add(time.Minute)), ErrReplayed)
+	assert.Equal(t, 2, c.Len())
+
+	now = now.Add(time.Hour)
+	assert.NoError(t, c.Add("a", now.Add(time.Minute)))
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestVerifyOneTime(t *testing.T) {
+	privateKey, _, err := generateTestKeys()
+	assert.NoError(t, err)
+	pk, err := New(writePublicKey(t, &privateKey.PublicKey), time.Minute, zap.NewNop(),
+		WithReplayCache(NewMemoryReplayCache(10)))
+	assert.NoError(t, err)
+
+	sign := func(jti string) string {
+		claims := jwt.MapClaims{
+			"sub": "test-subject",
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+		if jti != "" {
+			claims["jti"] = jti
+		}
+		s, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(privateKey)
+		assert.NoError(t, err)
+		return "Bearer " + s
+	}
+
+	token := sign("id-1")
+	claims, err := pk.Verify(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "id-1", claims.ID)
+	_, err = pk.Verify(token)
+	assert.EqualError(t, err, `token is already used: jti "id-1"`)
+
+	_, err = pk.Verify(sign("id-2"))
+	assert.NoError(t, err)
+	_, err = pk.Verify(sign(""))
+	assert.EqualError(t, err, "jti is required")
+}
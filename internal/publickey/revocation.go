@@ -0,0 +1,188 @@
+package publickey
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// revocationFile format of the revocation list. JSON is accepted too
+//
+//	jti: [token-id]
+//	subjects: [alice@example.com]
+//	issued_before:
+//	  bob@example.com: 2024-06-01T00:00:00Z
+type revocationFile struct {
+	IDs          []string          `yaml:"jti"`
+	Subjects     []string          `yaml:"subjects"`
+	IssuedBefore map[string]string `yaml:"issued_before"`
+}
+
+type revocationList struct {
+	ids          map[string]struct{}
+	subjects     map[string]struct{}
+	issuedBefore map[string]time.Time
+}
+
+// Revocation list of revoked token IDs, subjects and tokens of subjects issued before a time
+type Revocation struct {
+	file   string
+	logger *zap.Logger
+
+	mu      sync.RWMutex
+	list    *revocationList
+	hash    [sha256.Size]byte
+	modTime time.Time
+	size    int64
+}
+
+// WithRevocation reject tokens revoked by rv
+func WithRevocation(rv *Revocation) Option {
+	return func(pk *Publickey) {
+		pk.revocation = rv
+	}
+}
+
+// NewRevocation load the revocation list file
+func NewRevocation(file string, logger *zap.Logger) (*Revocation, error) {
+	rv := &Revocation{
+		file:   file,
+		logger: logger,
+		list:   &revocationList{},
+	}
+	if _, err := rv.Reload(); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// Reload read the file again. changed is true if the list is replaced
+func (rv *Revocation) Reload() (bool, error) {
+	f, err := os.Open(rv.file)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to open revocation list")
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to stat revocation list")
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(f); err != nil {
+		return false, errors.Wrap(err, "Failed to read revocation list")
+	}
+
+	hash := sha256.Sum256(buf.Bytes())
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.modTime = fi.ModTime()
+	rv.size = fi.Size()
+	if hash == rv.hash {
+		return false, nil
+	}
+	list, err := parseRevocation(buf.Bytes())
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to parse revocation list")
+	}
+	rv.list = list
+	rv.hash = hash
+	rv.logger.Info("Loaded revocation list",
+		zap.String("revocation", rv.file),
+		zap.Int("jti", len(list.ids)),
+		zap.Int("subjects", len(list.subjects)),
+		zap.Int("issued_before", len(list.issuedBefore)),
+	)
+	return true, nil
+}
+
+// Watch polls the file every interval and reloads it when the content changes.
+// onChange is called after the list is replaced
+func (rv *Revocation) Watch(ctx context.Context, interval time.Duration, onChange func()) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(rv.file)
+			if err != nil {
+				rv.logger.Error("Failed to stat revocation list. Keep current list", zap.Error(err))
+				continue
+			}
+			rv.mu.RLock()
+			unchanged := fi.ModTime().Equal(rv.modTime) && fi.Size() == rv.size
+			rv.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+			changed, err := rv.Reload()
+			if err != nil {
+				rv.logger.Error("Failed to reload revocation list. Keep current list",
+					zap.String("revocation", rv.file),
+					zap.Error(err))
+				continue
+			}
+			if changed && onChange != nil {
+				onChange()
+			}
+		}
+	}
+}
+
+// Check returns an error if the token of claims is revoked
+func (rv *Revocation) Check(c *Claims) error {
+	rv.mu.RLock()
+	list := rv.list
+	rv.mu.RUnlock()
+	if _, ok := list.ids[c.ID]; ok && c.ID != "" {
+		return fmt.Errorf("token is revoked: jti %q", c.ID)
+	}
+	if _, ok := list.subjects[c.Subject]; ok {
+		return fmt.Errorf("subject is revoked: %q", c.Subject)
+	}
+	if t, ok := list.issuedBefore[c.Subject]; ok && c.IssuedAt.Before(t) {
+		return fmt.Errorf("token of %q issued before %s is revoked", c.Subject, t.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func parseRevocation(b []byte) (*revocationList, error) {
+	var rf revocationFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&rf); err != nil && err != io.EOF {
+		return nil, err
+	}
+	list := &revocationList{
+		ids:          make(map[string]struct{}),
+		subjects:     make(map[string]struct{}),
+		issuedBefore: make(map[string]time.Time),
+	}
+	for _, id := range rf.IDs {
+		list.ids[id] = struct{}{}
+	}
+	for _, sub := range rf.Subjects {
+		list.subjects[sub] = struct{}{}
+	}
+	for sub, v := range rf.IssuedBefore {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid issued_before of %q", sub)
+		}
+		list.issuedBefore[sub] = t
+	}
+	return list, nil
+}
@@ -0,0 +1,84 @@
+package publickey
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRevocation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "revoked.yaml")
+	assert.NoError(t, os.WriteFile(file, []byte(""), 0o644))
+	rv, err := NewRevocation(file, zap.NewNop())
+	assert.NoError(t, err)
+
+	privateKey, _, err := generateTestKeys()
+	assert.NoError(t, err)
+	pk, err := New(writePublicKey(t, &privateKey.PublicKey), time.Hour, zap.NewNop(), WithRevocation(rv))
+	assert.NoError(t, err)
+
+	sign := func(sub, jti string, iat time.Time) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"sub": sub,
+			"jti": jti,
+			"iat": iat.Unix(),
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}).SignedString(privateKey)
+		assert.NoError(t, err)
+		return s
+	}
+	now := time.Now()
+	old := now.Add(-30 * time.Minute)
+	_, err = pk.Verify(sign("alice", "id-1", now))
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(file, []byte(`
+jti: [id-1]
+subjects: [mallory]
+issued_before:
+  bob: `+now.Add(-time.Minute).UTC().Format(time.RFC3339)+`
+`), 0o644))
+	changed, err := rv.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	changed, err = rv.Reload()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	_, err = pk.Verify(sign("alice", "id-1", now))
+	assert.EqualError(t, err, `token is revoked: jti "id-1"`)
+	_, err = pk.Verify(sign("alice", "id-2", now))
+	assert.NoError(t, err)
+	_, err = pk.Verify(sign("mallory", "id-3", now))
+	assert.EqualError(t, err, `subject is revoked: "mallory"`)
+	_, err = pk.Verify(sign("bob", "id-4", old))
+	assert.ErrorContains(t, err, `token of "bob" issued before`)
+	_, err = pk.Verify(sign("bob", "id-5", now))
+	assert.NoError(t, err)
+
+	// broken list keeps the current one
+	assert.NoError(t, os.WriteFile(file, []byte(`{"jti": ["id-2"], "unknown": 1}`), 0o644))
+	_, err = rv.Reload()
+	assert.Error(t, err)
+	_, err = pk.Verify(sign("alice", "id-1", now))
+	assert.Error(t, err)
+
+	// JSON
+	var calls int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rv.Watch(ctx, 10*time.Millisecond, func() { atomic.AddInt32(&calls, 1) })
+	assert.NoError(t, os.WriteFile(file, []byte(`{"jti": ["id-2"]}`), 0o644))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, 10*time.Millisecond)
+	_, err = pk.Verify(sign("alice", "id-1", now))
+	assert.NoError(t, err)
+	_, err = pk.Verify(sign("alice", "id-2", now))
+	assert.Error(t, err)
+}